@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The variables the app may be configured with, by order of precedence, so that they
+// don't have to be copied to the environment of raingutter
+var (
+	// threads of each process
+	threadsEnvVars = []string{"MAX_THREADS", "RAILS_MAX_THREADS", "PUMA_MAX_THREADS"}
+	// processes forked by the master
+	workersEnvVars = []string{"UNICORN_WORKERS", "WEB_CONCURRENCY"}
+)
+
+// appProcess identifies the processes of the app, which requires raingutter to share
+// its PID namespace
+type appProcess struct {
+	// eg: RG_TARGET_PID, looked up by Pattern otherwise
+	Pid     int
+	Pattern *regexp.Regexp
+}
+
+// find returns the pids of the app, the oldest first
+func (a appProcess) find(procRoot string) ([]int, error) {
+	if a.Pid != 0 {
+		return []int{a.Pid}, nil
+	}
+	if a.Pattern == nil {
+		return nil, errors.New("the app process is unknown")
+	}
+	pids, err := findProcesses(procRoot, a.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return nil, errors.New("no process matches the app " + a.Pattern.String())
+	}
+	return pids, nil
+}
+
+// environVar returns the first of names set to a positive number in environ
+func environVar(environ map[string]string, names []string) (float64, string, error) {
+	for _, name := range names {
+		if v := environ[name]; v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || n <= 0 {
+				return 0, "", errors.New("invalid " + name + " in the environment of the app: " + v)
+			}
+			return n, name, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// threadCapacity discovers the total number of threads of a multi-threaded app
+// from the running server
+type threadCapacity struct {
+	// MAX_THREADS of raingutter, takes precedence over the discovery when set
+	Override float64
+	// the Puma control app, eg: RG_PUMA_CONTROL_URL, nil when not set
+	Puma     *pumaControl
+	ProcRoot string
+	App      appProcess
+}
+
+// discover returns the number of threads of the app along with where it comes from.
+// The max_threads reported by Puma are preferred to the environment of the app, which
+// is preferred to the number of threads of its processes, which also counts the threads
+// not serving requests and the ones not spawned yet
+func (c *threadCapacity) discover() (float64, string, error) {
+	if c.Override != 0 {
+		return c.Override, "MAX_THREADS", nil
+	}
+
+	if c.Puma != nil {
+		// no worker may have booted yet in cluster mode
+		if stats, err := c.Puma.Stats(); err != nil {
+			log.Debug("could not get the number of threads from puma: ", err)
+		} else if threads := stats.maxThreads(); threads != 0 {
+			return threads, "puma", nil
+		}
+	}
+
+	pids, err := c.App.find(c.ProcRoot)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// the oldest process, which is the master in cluster mode
+	environ, err := readEnviron(c.ProcRoot, pids[0])
+	if err == nil {
+		threads, name, err := environVar(environ, threadsEnvVars)
+		if err != nil {
+			return 0, "", err
+		}
+		if threads != 0 {
+			// processes forked by the master in cluster mode
+			if workers, _, err := environVar(environ, []string{"WEB_CONCURRENCY"}); err == nil && workers != 0 {
+				threads *= workers
+			}
+			return threads, "environ:" + name, nil
+		}
+	} else {
+		log.Debug(err)
+	}
+
+	// the master of a cluster doesn't serve requests
+	if len(pids) > 1 {
+		pids = pids[1:]
+	}
+	var threads float64
+	for _, pid := range pids {
+		n, err := processThreads(c.ProcRoot, pid)
+		if err != nil {
+			// exited during the scan
+			continue
+		}
+		threads += n
+	}
+	if threads == 0 {
+		return 0, "", errors.New("could not count the threads of the app")
+	}
+	return threads, "threads", nil
+}
+
+// getThreads refreshes the number of threads of the app. The previous value is kept
+// when it can't be discovered
+func getThreads(tc *totalConnections, capacity *threadCapacity) {
+	threads, source, err := capacity.discover()
+	if err != nil {
+		log.Warning("could not discover the number of threads: ", err)
+		return
+	}
+	if threads != tc.Count {
+		log.WithFields(log.Fields{
+			"threads": threads,
+			"source":  source,
+		}).Info("number of threads updated")
+	}
+	tc.Count = threads
+}
+
+// readEnviron returns the environment of a process, from its /proc/<pid>/environ
+func readEnviron(procRoot string, pid int) (map[string]string, error) {
+	raw, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return nil, err
+	}
+
+	environ := make(map[string]string)
+	// variables are separated by NUL bytes
+	for _, v := range bytes.Split(raw, []byte{0}) {
+		if name, value, ok := strings.Cut(string(v), "="); ok && name != "" {
+			environ[name] = value
+		}
+	}
+	return environ, nil
+}
+
+// processThreads returns the number of threads of a process
+func processThreads(procRoot string, pid int) (float64, error) {
+	return processStatusField(procRoot, pid, "Threads")
+}
+
+// processStatusField returns a numeric field of the /proc/<pid>/status of a process,
+// eg: Threads or PPid
+func processStatusField(procRoot string, pid int, field string) (float64, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), field+":"); ok {
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no " + field + " in the status of pid " + strconv.Itoa(pid))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// writePumaCluster creates a fake /proc with a Puma master and 2 workers of 7 threads
+func writePumaCluster(t *testing.T, environ string) string {
+	procRoot := t.TempDir()
+	writeProcess(t, procRoot, "10", "puma 6.4.0 (tcp://0.0.0.0:3000) [app]\x00", nil)
+	writeProcess(t, procRoot, "12", "puma: cluster worker 0: 10 [app]\x00", nil)
+	writeProcess(t, procRoot, "13", "puma: cluster worker 1: 10 [app]\x00", nil)
+	writeProcess(t, procRoot, "20", "sleep infinity\x00", nil)
+	writeProcFile(t, procRoot, "10/environ", environ)
+	writeProcFile(t, procRoot, "10/status", "Name:\truby\nThreads:\t2\n")
+	writeProcFile(t, procRoot, "12/status", "Name:\truby\nThreads:\t7\n")
+	writeProcFile(t, procRoot, "13/status", "Name:\truby\nThreads:\t7\n")
+	return procRoot
+}
+
+func TestReadEnviron(t *testing.T) {
+	procRoot := writePumaCluster(t, "RAILS_ENV=production\x00DATABASE_URL=postgres://db/app?pool=5\x00EMPTY=\x00")
+	actual, err := readEnviron(procRoot, 10)
+	if err != nil {
+		t.Fatalf("readEnviron threw error (%v)", err)
+	}
+	expected := map[string]string{"RAILS_ENV": "production", "DATABASE_URL": "postgres://db/app?pool=5", "EMPTY": ""}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("readEnviron: expected %v, actual %v", expected, actual)
+	}
+	if _, err := readEnviron(procRoot, 99); err == nil {
+		t.Errorf("readEnviron did not raise error for a missing process")
+	}
+}
+
+func TestProcessThreads(t *testing.T) {
+	procRoot := writePumaCluster(t, "")
+	if actual, err := processThreads(procRoot, 12); err != nil || actual != 7 {
+		t.Errorf("processThreads: expected 7, actual %v (%v)", actual, err)
+	}
+	writeProcFile(t, procRoot, "30/status", "Name:\truby\n")
+	if _, err := processThreads(procRoot, 30); err == nil {
+		t.Errorf("processThreads did not raise error without a thread count")
+	}
+}
+
+func TestEnvironVar(t *testing.T) {
+	environ := map[string]string{"WEB_CONCURRENCY": "3", "RAILS_MAX_THREADS": "five"}
+	if n, name, err := environVar(environ, workersEnvVars); err != nil || n != 3 || name != "WEB_CONCURRENCY" {
+		t.Errorf("environVar: expected 3 from WEB_CONCURRENCY, actual %v from %v (%v)", n, name, err)
+	}
+	if n, name, err := environVar(environ, []string{"PUMA_MAX_THREADS"}); err != nil || n != 0 || name != "" {
+		t.Errorf("environVar: expected nothing, actual %v from %v (%v)", n, name, err)
+	}
+	if _, _, err := environVar(environ, threadsEnvVars); err == nil {
+		t.Errorf("environVar did not raise error for an invalid RAILS_MAX_THREADS")
+	}
+}
+
+func TestThreadCapacityDiscover(t *testing.T) {
+	puma := regexp.MustCompile("^puma")
+	for _, tc := range []struct {
+		name     string
+		environ  string
+		capacity threadCapacity
+		threads  float64
+		source   string
+	}{
+		{"override", "RAILS_MAX_THREADS=5\x00", threadCapacity{Override: 32, App: appProcess{Pattern: puma}}, 32, "MAX_THREADS"},
+		{"environ", "RAILS_MAX_THREADS=5\x00", threadCapacity{App: appProcess{Pattern: puma}}, 5, "environ:RAILS_MAX_THREADS"},
+		{"environ precedence", "RAILS_MAX_THREADS=5\x00MAX_THREADS=8\x00", threadCapacity{App: appProcess{Pattern: puma}}, 8, "environ:MAX_THREADS"},
+		{"environ cluster", "RAILS_MAX_THREADS=5\x00WEB_CONCURRENCY=2\x00", threadCapacity{App: appProcess{Pattern: puma}}, 10, "environ:RAILS_MAX_THREADS"},
+		// the threads of the master are not counted
+		{"thread count", "RAILS_ENV=production\x00", threadCapacity{App: appProcess{Pattern: puma}}, 14, "threads"},
+		{"target", "RAILS_ENV=production\x00", threadCapacity{App: appProcess{Pid: 12}}, 7, "threads"},
+	} {
+		tc.capacity.ProcRoot = writePumaCluster(t, tc.environ)
+		threads, source, err := tc.capacity.discover()
+		if err != nil {
+			t.Errorf("%v: discover threw error (%v)", tc.name, err)
+			continue
+		}
+		if threads != tc.threads || source != tc.source {
+			t.Errorf("%v: expected %v from %v, actual %v from %v", tc.name, tc.threads, tc.source, threads, source)
+		}
+	}
+
+	for _, capacity := range []threadCapacity{
+		{ProcRoot: writePumaCluster(t, "MAX_THREADS=many\x00"), App: appProcess{Pattern: puma}},
+		{ProcRoot: writePumaCluster(t, ""), App: appProcess{Pattern: regexp.MustCompile("^unicorn")}},
+		{ProcRoot: writePumaCluster(t, "")},
+	} {
+		if _, _, err := capacity.discover(); err == nil {
+			t.Errorf("discover did not raise error for %+v", capacity)
+		}
+	}
+}
+
+func TestThreadCapacityPuma(t *testing.T) {
+	ts := httptest.NewServer(pumaHandler(pumaClusterStats))
+	defer ts.Close()
+	puma, err := newPumaControl(ts.URL, "s3cr3t", raindropsOptions{Timeout: pumaTimeout})
+	if err != nil {
+		t.Fatalf("newPumaControl threw error (%v)", err)
+	}
+	capacity := threadCapacity{
+		Puma:     puma,
+		ProcRoot: writePumaCluster(t, "RAILS_MAX_THREADS=5\x00WEB_CONCURRENCY=3\x00"),
+		App:      appProcess{Pattern: regexp.MustCompile("^puma")},
+	}
+
+	// the worker which is not booted yet is not counted
+	if threads, source, err := capacity.discover(); err != nil || threads != 10 || source != "puma" {
+		t.Errorf("discover: expected 10 from puma, actual %v from %v (%v)", threads, source, err)
+	}
+
+	// the environment of the app is used when the control app can't be reached
+	puma.Token = "invalid"
+	if threads, source, err := capacity.discover(); err != nil || threads != 15 || source != "environ:RAILS_MAX_THREADS" {
+		t.Errorf("discover: expected 15 from environ:RAILS_MAX_THREADS, actual %v from %v (%v)", threads, source, err)
+	}
+}
+
+func TestGetThreads(t *testing.T) {
+	procRoot := writePumaCluster(t, "RAILS_MAX_THREADS=5\x00")
+	capacity := threadCapacity{ProcRoot: procRoot, App: appProcess{Pattern: regexp.MustCompile("^puma")}}
+	tc := totalConnections{}
+	getThreads(&tc, &capacity)
+	if tc.Count != 5 {
+		t.Errorf("expected 5 threads, actual %v", tc.Count)
+	}
+
+	// the config of the app changed
+	writeProcFile(t, procRoot, "10/environ", "RAILS_MAX_THREADS=8\x00")
+	getThreads(&tc, &capacity)
+	if tc.Count != 8 {
+		t.Errorf("expected 8 threads, actual %v", tc.Count)
+	}
+
+	// the app is gone, the last known value is kept
+	capacity.App.Pattern = regexp.MustCompile("^unicorn")
+	getThreads(&tc, &capacity)
+	if tc.Count != 8 {
+		t.Errorf("expected to keep 8 threads, actual %v", tc.Count)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"time"
+)
+
+// connectionTracker remembers when each active connection of a listener was first
+// seen, identified by the inode of its socket, to follow connections across polls
+type connectionTracker struct {
+	firstSeen map[string]time.Time
+	lastPoll  time.Time
+	// polls of the last window, to estimate the throughput
+	window  time.Duration
+	samples []throughputSample
+}
+
+type throughputSample struct {
+	at       time.Time
+	accepted float64
+	active   float64
+}
+
+// throughputStats estimates the request rate of a listener over the last window
+type throughputStats struct {
+	// connections accepted per second
+	Rate float64
+	// average number of active connections
+	MeanActive float64
+}
+
+// ServiceTime applies Little's law: the mean time a connection stays active is the
+// mean number of active connections divided by their arrival rate
+func (t *throughputStats) ServiceTime() time.Duration {
+	if t.Rate == 0 {
+		return 0
+	}
+	return time.Duration(t.MeanActive / t.Rate * float64(time.Second))
+}
+
+// connectionStats describes the connections of a listener since the previous poll
+type connectionStats struct {
+	// connections seen for the first time
+	Accepted float64
+	// lifetime of the connections which are gone
+	Lifetimes []time.Duration
+	// age of the oldest active connection
+	Oldest time.Duration
+}
+
+func newConnectionTracker(window time.Duration) *connectionTracker {
+	return &connectionTracker{firstSeen: map[string]time.Time{}, window: window}
+}
+
+// update records the active connections seen at now. Connections which are gone
+// are assumed to have been closed right after the previous poll
+func (t *connectionTracker) update(activeInodes []string, now time.Time) connectionStats {
+	var stats connectionStats
+	firstSeen := make(map[string]time.Time, len(activeInodes))
+	for _, inode := range activeInodes {
+		seen, ok := t.firstSeen[inode]
+		if !ok {
+			seen = now
+			stats.Accepted++
+		}
+		firstSeen[inode] = seen
+		if age := now.Sub(seen); age > stats.Oldest {
+			stats.Oldest = age
+		}
+	}
+
+	for inode, seen := range t.firstSeen {
+		if _, ok := firstSeen[inode]; !ok {
+			stats.Lifetimes = append(stats.Lifetimes, t.lastPoll.Sub(seen))
+		}
+	}
+
+	// connections found by the first poll were not accepted since the previous one
+	if t.lastPoll.IsZero() {
+		stats.Accepted = 0
+	}
+
+	t.firstSeen = firstSeen
+	t.lastPoll = now
+	return stats
+}
+
+// throughput records a poll and estimates the throughput over the window, it
+// returns nil until the window holds at least two polls
+func (t *connectionTracker) throughput(now time.Time, accepted float64, active float64) *throughputStats {
+	t.samples = append(t.samples, throughputSample{now, accepted, active})
+	start := 0
+	for start < len(t.samples)-2 && now.Sub(t.samples[start].at) > t.window {
+		start++
+	}
+	t.samples = t.samples[start:]
+	if len(t.samples) < 2 {
+		return nil
+	}
+
+	var stats throughputStats
+	// the connections accepted by the first poll came before the window
+	for i, s := range t.samples {
+		if i > 0 {
+			stats.Rate += s.accepted
+		}
+		stats.MeanActive += s.active
+	}
+	stats.Rate /= now.Sub(t.samples[0].at).Seconds()
+	stats.MeanActive /= float64(len(t.samples))
+	return &stats
+}
+
+// ScanConnections follows the active connections of each listener across polls
+// to report their age and the throughput, as enabled by opts.
+// It must be called after ScanListenersSocketStats
+func (r *raingutter) ScanConnections(trackers []*connectionTracker, stats []*SocketStats, now time.Time, opts socketStatsOptions) raingutter {
+	var connTotal *connectionStats
+	var throughputTotal *throughputStats
+	for i, t := range trackers {
+		cs := t.update(stats[i].ActiveInodes, now)
+		ts := t.throughput(now, cs.Accepted, r.Listeners[i].Active)
+
+		if opts.ConnectionAge {
+			r.Listeners[i].Connections = &cs
+			if connTotal == nil {
+				connTotal = &connectionStats{}
+			}
+			connTotal.Accepted += cs.Accepted
+			connTotal.Lifetimes = append(connTotal.Lifetimes, cs.Lifetimes...)
+			if cs.Oldest > connTotal.Oldest {
+				connTotal.Oldest = cs.Oldest
+			}
+		}
+		if opts.Throughput && ts != nil {
+			r.Listeners[i].Throughput = ts
+			if throughputTotal == nil {
+				throughputTotal = &throughputStats{}
+			}
+			throughputTotal.Rate += ts.Rate
+			throughputTotal.MeanActive += ts.MeanActive
+		}
+	}
+	// the `total` listener, if enabled, comes after the monitored ones
+	if len(r.Listeners) > len(trackers) {
+		r.Listeners[len(trackers)].Connections = connTotal
+		r.Listeners[len(trackers)].Throughput = throughputTotal
+	}
+	return *r
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnectionTracker(t *testing.T) {
+	tracker := newConnectionTracker(10 * time.Second)
+	start := time.Now()
+	polls := []struct {
+		inodes   []string
+		expected connectionStats
+	}{
+		// connections found by the first poll are not counted as accepted
+		{[]string{"1", "2"}, connectionStats{}},
+		{[]string{"1", "2", "3"}, connectionStats{Accepted: 1, Oldest: time.Second}},
+		{[]string{"1", "4"}, connectionStats{Accepted: 1, Lifetimes: []time.Duration{time.Second, 0}, Oldest: 2 * time.Second}},
+		{nil, connectionStats{Lifetimes: []time.Duration{2 * time.Second, 0}}},
+	}
+	for i, poll := range polls {
+		actual := tracker.update(poll.inodes, start.Add(time.Duration(i)*time.Second))
+		// connections are closed in no particular order
+		if len(actual.Lifetimes) == 2 && actual.Lifetimes[0] < actual.Lifetimes[1] {
+			actual.Lifetimes[0], actual.Lifetimes[1] = actual.Lifetimes[1], actual.Lifetimes[0]
+		}
+		if !reflect.DeepEqual(actual, poll.expected) {
+			t.Errorf("poll %v: expected %+v, actual %+v", i, poll.expected, actual)
+		}
+	}
+}
+
+func TestScanConnections(t *testing.T) {
+	listeners := []listener{{Port: 3000}, {Port: 9292}}
+	trackers := []*connectionTracker{newConnectionTracker(10 * time.Second), newConnectionTracker(10 * time.Second)}
+	start := time.Now()
+
+	r := raingutter{}
+	stats := []*SocketStats{{ActiveInodes: []string{"1"}}, {ActiveInodes: []string{"2"}}}
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{Total: true})
+	r.ScanConnections(trackers, stats, start, socketStatsOptions{ConnectionAge: true})
+
+	stats = []*SocketStats{{ActiveInodes: []string{"1"}}, {ActiveInodes: []string{"3", "4"}}}
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{Total: true})
+	r.ScanConnections(trackers, stats, start.Add(3*time.Second), socketStatsOptions{ConnectionAge: true})
+
+	expected := []*connectionStats{
+		{Oldest: 3 * time.Second},
+		{Accepted: 2, Lifetimes: []time.Duration{0}},
+		{Accepted: 2, Lifetimes: []time.Duration{0}, Oldest: 3 * time.Second},
+	}
+	for i, l := range r.Listeners {
+		if !reflect.DeepEqual(l.Connections, expected[i]) {
+			t.Errorf("listener %v: expected %+v, actual %+v", l.Listener, expected[i], l.Connections)
+		}
+	}
+}
+
+func TestConnectionTrackerThroughput(t *testing.T) {
+	tracker := newConnectionTracker(2 * time.Second)
+	start := time.Now()
+	polls := []struct {
+		accepted float64
+		active   float64
+		expected *throughputStats
+	}{
+		// a single poll doesn't give a rate
+		{0, 2, nil},
+		{4, 2, &throughputStats{Rate: 4, MeanActive: 2}},
+		{2, 5, &throughputStats{Rate: 3, MeanActive: 3}},
+		// the first poll is out of the window
+		{6, 3, &throughputStats{Rate: 4, MeanActive: 10.0 / 3}},
+	}
+	for i, poll := range polls {
+		actual := tracker.throughput(start.Add(time.Duration(i)*time.Second), poll.accepted, poll.active)
+		if !reflect.DeepEqual(actual, poll.expected) {
+			t.Errorf("poll %v: expected %+v, actual %+v", i, poll.expected, actual)
+		}
+	}
+}
+
+func TestServiceTime(t *testing.T) {
+	stats := throughputStats{Rate: 20, MeanActive: 5}
+	if actual := stats.ServiceTime(); actual != 250*time.Millisecond {
+		t.Errorf("expected 250ms, actual %v", actual)
+	}
+	// no connection was accepted during the window
+	stats = throughputStats{MeanActive: 5}
+	if actual := stats.ServiceTime(); actual != 0 {
+		t.Errorf("expected 0, actual %v", actual)
+	}
+}
+
+func TestScanConnectionsThroughput(t *testing.T) {
+	listeners := []listener{{Port: 3000}, {Port: 9292}}
+	trackers := []*connectionTracker{newConnectionTracker(10 * time.Second), newConnectionTracker(10 * time.Second)}
+	opts := socketStatsOptions{Total: true, Throughput: true}
+	start := time.Now()
+
+	r := raingutter{}
+	stats := []*SocketStats{{ActiveWorkers: 1, ActiveInodes: []string{"1"}}, {}}
+	r.ScanListenersSocketStats(listeners, stats, opts)
+	r.ScanConnections(trackers, stats, start, opts)
+	for _, l := range r.Listeners {
+		if l.Throughput != nil || l.Connections != nil {
+			t.Errorf("listener %v: expected no throughput, actual %+v", l.Listener, l.Throughput)
+		}
+	}
+
+	stats = []*SocketStats{{ActiveWorkers: 1, ActiveInodes: []string{"2"}}, {ActiveWorkers: 2, ActiveInodes: []string{"3", "4"}}}
+	r.ScanListenersSocketStats(listeners, stats, opts)
+	r.ScanConnections(trackers, stats, start.Add(2*time.Second), opts)
+
+	expected := []*throughputStats{
+		{Rate: 0.5, MeanActive: 1},
+		{Rate: 1, MeanActive: 1},
+		{Rate: 1.5, MeanActive: 2},
+	}
+	for i, l := range r.Listeners {
+		if !reflect.DeepEqual(l.Throughput, expected[i]) {
+			t.Errorf("listener %v: expected %+v, actual %+v", l.Listener, expected[i], l.Throughput)
+		}
+		if l.Connections != nil {
+			t.Errorf("listener %v: expected no connection stats, actual %+v", l.Listener, l.Connections)
+		}
+	}
+}
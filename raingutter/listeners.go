@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listener is a socket the web server accepts connections on: either a TCP port,
+// optionally bound to a single local address, or the path of a unix domain socket
+type listener struct {
+	Address netip.Addr
+	Port    int
+	Path    string
+}
+
+// String returns the value of the `listener` tag
+func (l listener) String() string {
+	if l.Path != "" {
+		return l.Path
+	}
+	if l.Address.IsValid() {
+		return netip.AddrPortFrom(l.Address, uint16(l.Port)).String()
+	}
+	return strconv.Itoa(l.Port)
+}
+
+// matches reports whether a TCP socket belongs to the listener. Sockets accepted
+// by dual stack listeners have IPv4-mapped IPv6 local addresses
+func (l listener) matches(socket Socket) bool {
+	if l.Path != "" || int(socket.LocalPort) != l.Port {
+		return false
+	}
+	return !l.Address.IsValid() || socket.LocalAddr.Unmap() == l.Address
+}
+
+// listenerStats holds the stats of a single listener, as sent to the sinks.
+// Optional stats are nil when disabled or not available for the listener
+type listenerStats struct {
+	Listener string
+	Active   float64
+	Queued   float64
+	States   *TCPStates
+	// maximum size of the accept queue, 0 when disabled or unknown
+	QueueLimit float64
+	// connections from the excluded networks
+	Excluded *float64
+	// active connections split between busy and idle keep-alive ones
+	KeepAlive *keepAliveStats
+	// connections followed across polls
+	Connections *connectionStats
+	// request rate and service time
+	Throughput *throughputStats
+	// network health of the active connections
+	TCPHealth *tcpHealthStats
+	// aggregates of Raindrops::Watcher
+	Watcher *watcherStats
+}
+
+type keepAliveStats struct {
+	Busy float64
+	Idle float64
+}
+
+// tcpHealthStats holds the tcp_info of each active connection, as distributions
+type tcpHealthStats struct {
+	RTTs []time.Duration
+	// segments retransmitted over the life of the connection
+	Retransmits []float64
+	// segments currently considered lost
+	Lost []float64
+}
+
+func (h *tcpHealthStats) add(info TCPInfo) {
+	h.RTTs = append(h.RTTs, time.Duration(info.RTT)*time.Microsecond)
+	h.Retransmits = append(h.Retransmits, float64(info.TotalRetrans))
+	h.Lost = append(h.Lost, float64(info.Lost))
+}
+
+// maxRTT returns the highest round trip time among the connections
+func (h *tcpHealthStats) maxRTT() time.Duration {
+	var max time.Duration
+	for _, rtt := range h.RTTs {
+		if rtt > max {
+			max = rtt
+		}
+	}
+	return max
+}
+
+// socketStatsOptions configures the optional stats of the built in socket monitoring
+type socketStatsOptions struct {
+	// report the sum of all listeners as the `total` listener
+	Total bool
+	// report the number of sockets in each TCP state
+	TCPStates bool
+	// report the backlog of each listener and how full its accept queue is
+	QueueLimit bool
+	// backlog requested by the app, used when the kernel can't report it
+	ListenBacklog float64
+	// remote networks whose connections are not counted as active
+	ExcludedNets excludedNets
+	// report the connections from ExcludedNets
+	Excluded bool
+	// report busy and idle keep-alive connections
+	KeepAlive bool
+	// leave idle keep-alive connections out of the active connections
+	ActiveBusyOnly bool
+	// report the age of the connections
+	ConnectionAge bool
+	// report the request rate and the service time
+	Throughput bool
+	// report the RTT, retransmits and lost segments of the active connections
+	TCPHealth bool
+}
+
+// queueRatio returns how full the accept queue is
+func (l listenerStats) queueRatio() float64 {
+	if l.QueueLimit == 0 {
+		return 0
+	}
+	return l.Queued / l.QueueLimit
+}
+
+// parseListeners builds the list of listeners out of the comma separated
+// RG_SERVER_PORT and RG_SERVER_SOCKET values. Ports can be bound to an address,
+// eg: `10.0.0.1:3000` or `[fd00::1]:3000`
+func parseListeners(ports string, sockets string) ([]listener, error) {
+	var listeners []listener
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if strings.Contains(p, ":") {
+			addrPort, err := netip.ParseAddrPort(p)
+			if err != nil || addrPort.Port() == 0 {
+				return nil, errors.New("invalid server address: " + p)
+			}
+			listeners = append(listeners, listener{Address: addrPort.Addr().Unmap(), Port: int(addrPort.Port())})
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, errors.New("invalid server port: " + p)
+		}
+		listeners = append(listeners, listener{Port: port})
+	}
+	for _, path := range strings.Split(sockets, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		listeners = append(listeners, listener{Path: path})
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no listener to monitor")
+	}
+	return listeners, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+var ListenersConfigs = []struct {
+	ports    string
+	sockets  string
+	expected []listener
+}{
+	{"3000", "", []listener{{Port: 3000}}},
+	{"3000, 9292,", "", []listener{{Port: 3000}, {Port: 9292}}},
+	{"", "/tmp/unicorn.sock", []listener{{Path: "/tmp/unicorn.sock"}}},
+	{"3000", "/tmp/a.sock,/tmp/b.sock", []listener{{Port: 3000}, {Path: "/tmp/a.sock"}, {Path: "/tmp/b.sock"}}},
+	{"10.0.0.1:3000,[fd00::1]:3000", "", []listener{
+		{Address: netip.MustParseAddr("10.0.0.1"), Port: 3000},
+		{Address: netip.MustParseAddr("fd00::1"), Port: 3000},
+	}},
+	{"[::ffff:10.0.0.1]:3000", "", []listener{{Address: netip.MustParseAddr("10.0.0.1"), Port: 3000}}},
+}
+
+func TestParseListeners(t *testing.T) {
+	for _, out := range ListenersConfigs {
+		actual, err := parseListeners(out.ports, out.sockets)
+		if err != nil {
+			t.Errorf("parseListeners threw error (%v)", err)
+		}
+		if !reflect.DeepEqual(actual, out.expected) {
+			t.Errorf("parseListeners(%v, %v): expected %v, actual %v", out.ports, out.sockets, out.expected, actual)
+		}
+	}
+}
+
+func TestParseListenersErrors(t *testing.T) {
+	for _, ports := range []string{"", "foo", "3000,70000", "10.0.0.1:0", "10.0.0.256:3000", "fd00::1:3000"} {
+		_, err := parseListeners(ports, "")
+		if err == nil {
+			t.Errorf("parseListeners did not raise error for (%v)", ports)
+		}
+	}
+}
+
+func TestListenerString(t *testing.T) {
+	listeners := map[string]listener{
+		"3000":              {Port: 3000},
+		"10.0.0.1:3000":     {Address: netip.MustParseAddr("10.0.0.1"), Port: 3000},
+		"[fd00::1]:3000":    {Address: netip.MustParseAddr("fd00::1"), Port: 3000},
+		"/tmp/unicorn.sock": {Path: "/tmp/unicorn.sock"},
+	}
+	for expected, l := range listeners {
+		if l.String() != expected {
+			t.Errorf("listener.String(): expected %v, actual %v", expected, l.String())
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// socketMonitor keeps the state of the built in socket monitoring of a network
+// namespace across polls
+type socketMonitor struct {
+	// procfs or netlink, switched to procfs for good if netlink is denied
+	Collector string
+	Target    targetProcess
+	Listeners []listener
+	Opts      socketStatsOptions
+	// nil when worker attribution is disabled
+	Workers       *workerTracker
+	WorkerPattern *regexp.Regexp
+	// restricts worker attribution to these processes, all of them when nil
+	WorkerPids map[int]bool
+
+	tables      socketTableReader
+	window      time.Duration
+	connections []*connectionTracker
+	listenDrops listenDropsTracker
+}
+
+func newSocketMonitor(collector string, target targetProcess, listeners []listener, opts socketStatsOptions, window time.Duration) *socketMonitor {
+	m := &socketMonitor{
+		Collector: collector,
+		Target:    target,
+		Listeners: listeners,
+		Opts:      opts,
+		window:    window,
+	}
+	m.reset()
+	return m
+}
+
+// reset forgets the state tied to the network namespace of the target: the
+// connections and the listen drop counters of another namespace are unrelated
+func (m *socketMonitor) reset() {
+	m.connections = make([]*connectionTracker, len(m.Listeners))
+	for i := range m.Listeners {
+		m.connections[i] = newConnectionTracker(m.window)
+	}
+	m.listenDrops = listenDropsTracker{}
+}
+
+// poll collects the socket stats of the listeners into r
+func (m *socketMonitor) poll(r *raingutter) error {
+	changed, err := m.Target.resolve()
+	if err != nil {
+		return err
+	}
+	if changed {
+		m.reset()
+	}
+	stats, err := collectSocketStats(&m.Collector, &m.Target, &m.tables, m.Listeners, m.Opts)
+	if err != nil {
+		return err
+	}
+
+	r.ScanListenersSocketStats(m.Listeners, stats, m.Opts)
+	r.MalformedLines = m.tables.Malformed
+	if m.Opts.ConnectionAge || m.Opts.Throughput {
+		r.ScanConnections(m.connections, stats, time.Now(), m.Opts)
+	}
+	if m.Workers != nil {
+		r.Workers = collectWorkers(m.Workers, m.Target.procRoot(), m.WorkerPattern, m.WorkerPids, stats)
+	}
+	return nil
+}
+
+// collectListenDrops reads the listen overflow and drop counters of the network
+// namespace and returns their increase since the previous call
+func (m *socketMonitor) collectListenDrops() *ListenDrops {
+	netstat, err := GetNetstat(m.Target.netDir())
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	counters, err := ParseNetstat(netstat)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	delta := m.listenDrops.delta(counters)
+	return &delta
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ListenDrops holds the kernel counters of connections refused by the listeners
+// of the network namespace, because their accept queue was full
+type ListenDrops struct {
+	// times the accept queue of a listener overflowed
+	Overflows float64
+	// connections dropped by a listener, overflows included
+	Drops float64
+}
+
+// GetNetstat returns the content of netstat in netDir, eg: /proc/net/netstat
+func GetNetstat(netDir string) (string, error) {
+	s, err := ioutil.ReadFile(filepath.Join(netDir, "netstat"))
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// ParseNetstat extracts ListenOverflows and ListenDrops from the output of GetNetstat.
+// Each section of /proc/net/netstat is made of a line with the names of the counters
+// followed by a line with their values:
+// TcpExt: SyncookiesSent ... ListenOverflows ListenDrops ...
+// TcpExt: 0 ... 12 12 ...
+func ParseNetstat(netstat string) (*ListenDrops, error) {
+	lines := strings.Split(netstat, "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "TcpExt:") {
+			continue
+		}
+		names := strings.Fields(lines[i])
+		values := strings.Fields(lines[i+1])
+		if len(names) != len(values) {
+			return nil, errors.New("could not parse TcpExt counters - names and values don't match")
+		}
+
+		counters := map[string]float64{}
+		for j, name := range names[1:] {
+			if name != "ListenOverflows" && name != "ListenDrops" {
+				continue
+			}
+			value, err := strconv.ParseFloat(values[j+1], 64)
+			if err != nil {
+				return nil, err
+			}
+			counters[name] = value
+		}
+		overflows, ok := counters["ListenOverflows"]
+		if !ok {
+			return nil, errors.New("ListenOverflows counter is missing")
+		}
+		drops, ok := counters["ListenDrops"]
+		if !ok {
+			return nil, errors.New("ListenDrops counter is missing")
+		}
+		return &ListenDrops{overflows, drops}, nil
+	}
+	return nil, errors.New("TcpExt counters are missing")
+}
+
+// listenDropsTracker turns the kernel counters into per poll deltas
+type listenDropsTracker struct {
+	last *ListenDrops
+}
+
+// delta returns the increase of the counters since the previous call, which is
+// zero on the first call. The counters only go back when the network namespace
+// is recreated, in which case the current values are the increase
+func (t *listenDropsTracker) delta(current *ListenDrops) ListenDrops {
+	var d ListenDrops
+	if t.last != nil {
+		d.Overflows = counterDelta(t.last.Overflows, current.Overflows)
+		d.Drops = counterDelta(t.last.Drops, current.Drops)
+	}
+	t.last = current
+	return d
+}
+
+func counterDelta(last float64, current float64) float64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+const netstatOutput = `TcpExt: SyncookiesSent SyncookiesRecv DelayedACKLost ListenOverflows ListenDrops TCPHPHits
+TcpExt: 0 0 3 12 15 1224
+IpExt: InNoRoutes InTruncatedPkts
+IpExt: 0 0
+`
+
+func TestParseNetstat(t *testing.T) {
+	actual, err := ParseNetstat(netstatOutput)
+	if err != nil {
+		t.Fatalf("ParseNetstat threw error (%v)", err)
+	}
+	expected := ListenDrops{Overflows: 12, Drops: 15}
+	if *actual != expected {
+		t.Errorf("ParseNetstat: expected %v, actual %v", expected, *actual)
+	}
+}
+
+var NetstatErrors = []string{
+	"",
+	"IpExt: InNoRoutes\nIpExt: 0",
+	"TcpExt: ListenOverflows ListenDrops\nTcpExt: 0",
+	"TcpExt: ListenOverflows ListenDrops\nTcpExt: 0 foo",
+	"TcpExt: ListenOverflows\nTcpExt: 0",
+}
+
+func TestParseNetstatErrors(t *testing.T) {
+	for _, netstat := range NetstatErrors {
+		_, err := ParseNetstat(netstat)
+		if err == nil {
+			t.Errorf("ParseNetstat did not raise error for (%v)", netstat)
+		}
+	}
+}
+
+func TestListenDropsTracker(t *testing.T) {
+	tracker := listenDropsTracker{}
+	polls := []struct {
+		counters ListenDrops
+		expected ListenDrops
+	}{
+		{ListenDrops{10, 12}, ListenDrops{0, 0}},
+		{ListenDrops{10, 12}, ListenDrops{0, 0}},
+		{ListenDrops{15, 20}, ListenDrops{5, 8}},
+		// the network namespace was recreated
+		{ListenDrops{2, 3}, ListenDrops{2, 3}},
+	}
+	for i, poll := range polls {
+		counters := poll.counters
+		actual := tracker.delta(&counters)
+		if actual != poll.expected {
+			t.Errorf("poll %v: expected %v, actual %v", i, poll.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	log "github.com/sirupsen/logrus"
+)
+
+// In node mode a single privileged raingutter per node monitors the network namespace
+// of every pod which opts in with the port annotation, instead of running as a sidecar
+const (
+	portAnnotation     = "raingutter.zendesk.com/port"
+	socketAnnotation   = "raingutter.zendesk.com/socket"
+	projectAnnotation  = "raingutter.zendesk.com/project"
+	capacityAnnotation = "raingutter.zendesk.com/capacity"
+)
+
+// podInfo identifies the pod the stats come from
+type podInfo struct {
+	Name      string
+	Namespace string
+	Project   string
+}
+
+// kubeletPod holds the fields of a pod listed by the kubelet raingutter uses
+type kubeletPod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		UID         string            `json:"uid"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Status struct {
+		Phase             string `json:"phase"`
+		ContainerStatuses []struct {
+			// the runtime followed by the ID, eg: containerd://<id>
+			ContainerID string `json:"containerID"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// kubeletClient lists the pods of the node from the local kubelet
+type kubeletClient struct {
+	Client *http.Client
+	// the pods endpoint, eg: https://127.0.0.1:10250/pods
+	URL string
+	// service account token, read again by every request as it is rotated
+	TokenFile string
+}
+
+// Pods returns the pods scheduled on the node
+func (k *kubeletClient) Pods() ([]kubeletPod, error) {
+	req, err := http.NewRequest("GET", k.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.TokenFile != "" {
+		token, err := os.ReadFile(k.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("could not list the pods of the node: " + resp.Status)
+	}
+
+	var pods struct {
+		Items []kubeletPod `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// containerIDPattern matches the ID of a container in the cgroup path of its processes,
+// eg: /kubepods/burstable/pod<uid>/<id> or /kubepods.slice/.../cri-containerd-<id>.scope
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// processContainerID returns the ID of the container of a process out of the content
+// of its /proc/<pid>/cgroup, empty if the process doesn't run in a container
+func processContainerID(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if ids := containerIDPattern.FindAllString(fields[2], -1); len(ids) > 0 {
+			return ids[len(ids)-1]
+		}
+	}
+	return ""
+}
+
+// GetContainerProcesses maps the ID of each container running on the node to the
+// sorted pids of its processes. Processes which exit during the scan are skipped
+func GetContainerProcesses(procRoot string) (map[string][]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := map[string][]int{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		cgroup, err := os.ReadFile(filepath.Join(procRoot, e.Name(), "cgroup"))
+		if err != nil {
+			continue
+		}
+		if id := processContainerID(string(cgroup)); id != "" {
+			containers[id] = append(containers[id], pid)
+		}
+	}
+	for _, pids := range containers {
+		sort.Ints(pids)
+	}
+	return containers, nil
+}
+
+// podMonitor holds the state of a monitored pod across polls
+type podMonitor struct {
+	Pod      podInfo
+	Capacity totalConnections
+	Monitor  *socketMonitor
+	Stats    raingutter
+	// tags the metrics with the pod
+	Statsd statsd.ClientInterface
+}
+
+// nodeMonitor follows the pods of the node which opt in to be monitored
+type nodeMonitor struct {
+	ProcRoot string
+	// creates the socket monitor of a new pod
+	NewMonitor func(listeners []listener) *socketMonitor
+	// creates the statsd client of a new pod
+	NewStatsd func(pod podInfo) statsd.ClientInterface
+	// by pod UID
+	Pods map[string]*podMonitor
+}
+
+// refresh lists the pods of the node and their processes, see update
+func (n *nodeMonitor) refresh(kubelet *kubeletClient) ([]podInfo, error) {
+	pods, err := kubelet.Pods()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := GetContainerProcesses(n.ProcRoot)
+	if err != nil {
+		return nil, err
+	}
+	return n.update(pods, containers), nil
+}
+
+// update starts monitoring the running pods which opt in and stops monitoring the
+// ones which are gone, which are returned. Pods whose processes can't be found are
+// skipped until the next update
+func (n *nodeMonitor) update(pods []kubeletPod, containers map[string][]int) []podInfo {
+	seen := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		port := pod.Metadata.Annotations[portAnnotation]
+		socket := pod.Metadata.Annotations[socketAnnotation]
+		if (port == "" && socket == "") || pod.Status.Phase != "Running" {
+			continue
+		}
+
+		var pids []int
+		for _, c := range pod.Status.ContainerStatuses {
+			// strip the runtime, eg: containerd://
+			_, id, _ := strings.Cut(c.ContainerID, "://")
+			pids = append(pids, containers[id]...)
+		}
+		if len(pids) == 0 {
+			continue
+		}
+		sort.Ints(pids)
+
+		uid := pod.Metadata.UID
+		pm, ok := n.Pods[uid]
+		if !ok {
+			var err error
+			pm, err = n.newPodMonitor(pod)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"pod_name":      pod.Metadata.Name,
+					"pod_namespace": pod.Metadata.Namespace,
+				}).Warning(err)
+				continue
+			}
+			n.Pods[uid] = pm
+			log.WithFields(log.Fields{
+				"pod_name":      pm.Pod.Name,
+				"pod_namespace": pm.Pod.Namespace,
+			}).Info("monitoring pod")
+		}
+		seen[uid] = true
+
+		// the containers of a pod share its network namespace
+		pm.Monitor.Target.Pid = pids[0]
+		pm.Monitor.WorkerPids = make(map[int]bool, len(pids))
+		for _, pid := range pids {
+			pm.Monitor.WorkerPids[pid] = true
+		}
+	}
+
+	var gone []podInfo
+	for uid, pm := range n.Pods {
+		if !seen[uid] {
+			delete(n.Pods, uid)
+			gone = append(gone, pm.Pod)
+			log.WithFields(log.Fields{
+				"pod_name":      pm.Pod.Name,
+				"pod_namespace": pm.Pod.Namespace,
+			}).Info("stopped monitoring pod")
+		}
+	}
+	return gone
+}
+
+func (n *nodeMonitor) newPodMonitor(pod kubeletPod) (*podMonitor, error) {
+	annotations := pod.Metadata.Annotations
+	listeners, err := parseListeners(annotations[portAnnotation], annotations[socketAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &podMonitor{
+		Pod: podInfo{
+			Name:      pod.Metadata.Name,
+			Namespace: pod.Metadata.Namespace,
+			Project:   annotations[projectAnnotation],
+		},
+		Monitor: n.NewMonitor(listeners),
+	}
+	if pm.Pod.Project == "" {
+		pm.Pod.Project = pod.Metadata.Labels["project"]
+	}
+	if capacity := annotations[capacityAnnotation]; capacity != "" {
+		pm.Capacity.Count, err = strconv.ParseFloat(capacity, 64)
+		if err != nil {
+			return nil, errors.New("invalid " + capacityAnnotation + ": " + capacity)
+		}
+	}
+	pm.Monitor.Target.ProcRoot = n.ProcRoot
+	pm.Stats.Pod = &pm.Pod
+	if n.NewStatsd != nil {
+		pm.Statsd = n.NewStatsd(pm.Pod)
+	}
+	return pm, nil
+}
+
+// taggedClient adds tags to every metric sent through a statsd client
+type taggedClient struct {
+	statsd.ClientInterface
+	tags []string
+}
+
+// podStatsdClient tags the metrics sent through c with the pod
+func podStatsdClient(c statsd.ClientInterface, pod podInfo) statsd.ClientInterface {
+	tags := []string{"pod_name:" + pod.Name, "pod_namespace:" + pod.Namespace}
+	if pod.Project != "" {
+		tags = append(tags, "project:"+pod.Project)
+	}
+	return taggedClient{c, tags}
+}
+
+// withTags returns the tags of the metric followed by the ones of the client, without
+// modifying the slice of the caller
+func (c taggedClient) withTags(tags []string) []string {
+	return append(tags[:len(tags):len(tags)], c.tags...)
+}
+
+func (c taggedClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	return c.ClientInterface.Histogram(name, value, c.withTags(tags), rate)
+}
+
+func (c taggedClient) Count(name string, value int64, tags []string, rate float64) error {
+	return c.ClientInterface.Count(name, value, c.withTags(tags), rate)
+}
+
+func (c taggedClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	return c.ClientInterface.Gauge(name, value, c.withTags(tags), rate)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+)
+
+var (
+	appContainer     = strings.Repeat("a1", 32)
+	sidecarContainer = strings.Repeat("b2", 32)
+)
+
+var CgroupContents = []struct {
+	raw      string
+	expected string
+}{
+	// cgroup v1 with cgroupfs
+	{"12:memory:/kubepods/burstable/pod0c1e4d5c-7c4b-4bd1-9bd5-9c1f0b2d9a51/" + appContainer + "\n11:cpu:/kubepods/burstable/pod0c1e4d5c-7c4b-4bd1-9bd5-9c1f0b2d9a51/" + appContainer + "\n", appContainer},
+	// cgroup v2 with systemd
+	{"0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0c1e4d5c_7c4b.slice/cri-containerd-" + appContainer + ".scope\n", appContainer},
+	{"0::/system.slice/docker-" + appContainer + ".scope\n", appContainer},
+	// processes of the host
+	{"0::/system.slice/kubelet.service\n", ""},
+	{"0::/\n", ""},
+}
+
+func TestProcessContainerID(t *testing.T) {
+	for _, out := range CgroupContents {
+		if actual := processContainerID(out.raw); actual != out.expected {
+			t.Errorf("processContainerID(%v): expected %v, actual %v", out.raw, out.expected, actual)
+		}
+	}
+}
+
+// writeCgroup creates a fake /proc/<pid>/cgroup
+func writeCgroup(t *testing.T, procRoot string, pid string, container string) {
+	cgroup := "0::/system.slice/sshd.service\n"
+	if container != "" {
+		cgroup = "0::/kubepods.slice/cri-containerd-" + container + ".scope\n"
+	}
+	writeProcFile(t, procRoot, filepath.Join(pid, "cgroup"), cgroup)
+}
+
+func TestGetContainerProcesses(t *testing.T) {
+	procRoot := t.TempDir()
+	writeCgroup(t, procRoot, "1", "")
+	writeCgroup(t, procRoot, "120", appContainer)
+	writeCgroup(t, procRoot, "101", appContainer)
+	writeCgroup(t, procRoot, "130", sidecarContainer)
+	writeProcFile(t, procRoot, "sys/kernel/pid_max", "4194304\n")
+
+	actual, err := GetContainerProcesses(procRoot)
+	if err != nil {
+		t.Fatalf("GetContainerProcesses threw error (%v)", err)
+	}
+	expected := map[string][]int{
+		appContainer:     {101, 120},
+		sidecarContainer: {130},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("GetContainerProcesses: expected %v, actual %v", expected, actual)
+	}
+}
+
+// newKubeletPod builds a pod as listed by the kubelet
+func newKubeletPod(uid string, name string, annotations map[string]string, containers ...string) kubeletPod {
+	var pod kubeletPod
+	pod.Metadata.UID = uid
+	pod.Metadata.Name = name
+	pod.Metadata.Namespace = "default"
+	pod.Metadata.Labels = map[string]string{"project": "classic"}
+	pod.Metadata.Annotations = annotations
+	pod.Status.Phase = "Running"
+	for _, c := range containers {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, struct {
+			ContainerID string `json:"containerID"`
+		}{"containerd://" + c})
+	}
+	return pod
+}
+
+func TestKubeletClientPods(t *testing.T) {
+	pods := []kubeletPod{newKubeletPod("1", "classic-web-1", map[string]string{portAnnotation: "3000"}, appContainer)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pods" || r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "PodList", "items": pods})
+	}))
+	defer ts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kubelet := kubeletClient{Client: ts.Client(), URL: ts.URL + "/pods", TokenFile: tokenFile}
+	actual, err := kubelet.Pods()
+	if err != nil {
+		t.Fatalf("Pods threw error (%v)", err)
+	}
+	if !reflect.DeepEqual(actual, pods) {
+		t.Errorf("Pods: expected %+v, actual %+v", pods, actual)
+	}
+
+	kubelet.TokenFile = ""
+	if _, err := kubelet.Pods(); err == nil {
+		t.Errorf("Pods did not raise error without a token")
+	}
+}
+
+func TestNodeMonitorUpdate(t *testing.T) {
+	node := nodeMonitor{
+		ProcRoot: "/host/proc",
+		Pods:     map[string]*podMonitor{},
+		NewMonitor: func(listeners []listener) *socketMonitor {
+			return newSocketMonitor("procfs", targetProcess{}, listeners, socketStatsOptions{}, 0)
+		},
+	}
+	web := newKubeletPod("1", "classic-web-1", map[string]string{
+		portAnnotation:     "3000",
+		capacityAnnotation: "16",
+		projectAnnotation:  "classic-web",
+	}, appContainer, sidecarContainer)
+	pending := newKubeletPod("2", "classic-web-2", map[string]string{portAnnotation: "3000"}, "")
+	pending.Status.Phase = "Pending"
+	optedOut := newKubeletPod("3", "classic-worker-1", nil, sidecarContainer)
+	invalid := newKubeletPod("4", "classic-web-3", map[string]string{portAnnotation: "http"}, appContainer)
+	containers := map[string][]int{
+		appContainer:     {101, 120},
+		sidecarContainer: {90},
+	}
+
+	gone := node.update([]kubeletPod{web, pending, optedOut, invalid}, containers)
+	if len(gone) != 0 || len(node.Pods) != 1 {
+		t.Fatalf("expected to monitor classic-web-1 only, actual %v (gone: %v)", node.Pods, gone)
+	}
+	pm := node.Pods["1"]
+	expected := podInfo{Name: "classic-web-1", Namespace: "default", Project: "classic-web"}
+	if pm.Pod != expected || pm.Stats.Pod != &pm.Pod || pm.Capacity.Count != 16 {
+		t.Errorf("expected %+v with a capacity of 16, actual %+v with %v", expected, pm.Pod, pm.Capacity.Count)
+	}
+	if pm.Monitor.Target.Pid != 90 || pm.Monitor.Target.ProcRoot != "/host/proc" {
+		t.Errorf("expected the namespace of pid 90 in /host/proc, actual %+v", pm.Monitor.Target)
+	}
+	if !reflect.DeepEqual(pm.Monitor.WorkerPids, map[int]bool{90: true, 101: true, 120: true}) {
+		t.Errorf("expected the processes of both containers, actual %v", pm.Monitor.WorkerPids)
+	}
+	if !reflect.DeepEqual(pm.Monitor.Listeners, []listener{{Port: 3000}}) {
+		t.Errorf("expected port 3000, actual %v", pm.Monitor.Listeners)
+	}
+
+	// the sidecar restarted, the monitor is kept
+	containers[sidecarContainer] = []int{140}
+	node.update([]kubeletPod{web}, containers)
+	if node.Pods["1"] != pm || pm.Monitor.Target.Pid != 101 {
+		t.Errorf("expected to keep monitoring pid 101, actual %+v", pm.Monitor.Target)
+	}
+
+	gone = node.update(nil, containers)
+	if len(node.Pods) != 0 || !reflect.DeepEqual(gone, []podInfo{expected}) {
+		t.Errorf("expected classic-web-1 to be gone, actual %v", gone)
+	}
+}
+
+// recordingClient records the tags of the metrics sent through it
+type recordingClient struct {
+	statsd.NoOpClient
+	tags [][]string
+}
+
+func (c *recordingClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	c.tags = append(c.tags, tags)
+	return nil
+}
+
+func TestPodStatsdClient(t *testing.T) {
+	recorder := &recordingClient{}
+	c := podStatsdClient(recorder, podInfo{Name: "classic-web-1", Namespace: "default", Project: "classic"})
+
+	tags := make([]string, 1, 4)
+	tags[0] = "listener:3000"
+	if err := c.Histogram("active", 1, tags, 1); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"listener:3000", "pod_name:classic-web-1", "pod_namespace:default", "project:classic"}}
+	if !reflect.DeepEqual(recorder.tags, expected) {
+		t.Errorf("expected %v, actual %v", expected, recorder.tags)
+	}
+	// the tags of the caller are left untouched
+	if tags[:cap(tags)][1] != "" {
+		t.Errorf("the tags of the caller were modified: %v", tags[:cap(tags)])
+	}
+}
+
+func TestNodeModeStatsdTags(t *testing.T) {
+	defer func(name, namespace, proj string) { podName, podNameSpace, project = name, namespace, proj }(podName, podNameSpace, project)
+	podName, podNameSpace, project = "raingutter-abcde", "monitoring", "raingutter"
+
+	if actual, expected := newStatsdTags(false, "env:production"), []string{"pod_name:raingutter-abcde", "pod_namespace:monitoring", "project:raingutter", "env:production"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("newStatsdTags: expected %v, actual %v", expected, actual)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := statsd.New(conn.LocalAddr().String(), statsd.WithTags(newStatsdTags(true, "env:production")), statsd.WithoutTelemetry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c := podStatsdClient(client, podInfo{Name: "classic-web-1", Namespace: "default", Project: "classic"})
+	if err := c.Histogram("active", 1, []string{"listener:3000"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	client.Flush()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tags of raingutter's own pod would conflict with the ones of the monitored pod
+	expected := "active:1|h|#env:production,listener:3000,pod_name:classic-web-1,pod_namespace:default,project:classic"
+	if actual := strings.TrimSpace(string(buf[:n])); actual != expected {
+		t.Errorf("expected %v, actual %v", expected, actual)
+	}
+}
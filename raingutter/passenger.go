@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// passengerStatus is the output of `passenger-status --show=xml`
+type passengerStatus struct {
+	// maximum number of processes of the pool
+	Max          float64 `xml:"max"`
+	ProcessCount float64 `xml:"process_count"`
+	// requests waiting for the pool to have room for a new process
+	WaitListSize float64 `xml:"get_wait_list_size"`
+	SuperGroups  []struct {
+		Name   string           `xml:"name"`
+		Groups []passengerGroup `xml:"group"`
+	} `xml:"supergroups>supergroup"`
+}
+
+// passengerGroup is an application of the pool and its processes
+type passengerGroup struct {
+	Name string `xml:"name"`
+	// requests waiting for a process of the application
+	WaitListSize float64 `xml:"get_wait_list_size"`
+	Processes    []struct {
+		Pid int `xml:"pid"`
+		// requests being processed
+		Sessions float64 `xml:"sessions"`
+	} `xml:"processes>process"`
+}
+
+// passengerTimeout is how long passenger-status is given to answer
+const passengerTimeout = 3 * time.Second
+
+// GetPassengerStatus runs passenger-status, eg: /usr/sbin/passenger-status, and
+// parses its output. It needs access to the instance directory of Passenger, see
+// PASSENGER_INSTANCE_REGISTRY_DIR. The command is killed after timeout, so that a
+// stuck instance doesn't block the polling
+func GetPassengerStatus(command string, timeout time.Duration) (passengerStatus, error) {
+	var out bytes.Buffer
+	cmd := execCommand(command, "--show=xml")
+	cmd.Stdout = &out
+	// children of passenger-status holding its output open don't block Wait either
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return passengerStatus{}, errors.New("could not run " + command + ": " + err.Error())
+	}
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if timedOut.Load() {
+		return passengerStatus{}, errors.New(command + " timed out after " + timeout.String())
+	}
+	if err != nil {
+		return passengerStatus{}, errors.New("could not run " + command + ": " + err.Error())
+	}
+	return ParsePassengerStatus(out.Bytes())
+}
+
+// ParsePassengerStatus parses the output of `passenger-status --show=xml`
+func ParsePassengerStatus(out []byte) (passengerStatus, error) {
+	var status passengerStatus
+	decoder := xml.NewDecoder(bytes.NewReader(out))
+	// passenger-status declares the iso8859-1 encoding
+	decoder.CharsetReader = latin1Reader
+	if err := decoder.Decode(&status); err != nil {
+		return passengerStatus{}, errors.New("could not parse the passenger status: " + err.Error())
+	}
+	return status, nil
+}
+
+// latin1Reader converts an ISO-8859-1 input to UTF-8
+func latin1Reader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso8859-1", "iso-8859-1", "latin1":
+	default:
+		return nil, errors.New("unsupported charset: " + charset)
+	}
+	raw, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	// the code points of ISO-8859-1 are the first 256 of Unicode
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return strings.NewReader(string(runes)), nil
+}
+
+// ScanPassengerStatus maps the status of a Passenger pool to raingutter: active is the
+// number of processes processing a request and queued the requests waiting for a
+// process, across all the applications. It returns the maximum size of the pool,
+// which is the capacity
+func (r *raingutter) ScanPassengerStatus(s passengerStatus) float64 {
+	r.Listeners = r.Listeners[:0]
+	r.Active = 0
+	r.Queued = s.WaitListSize
+	for _, sg := range s.SuperGroups {
+		for _, g := range sg.Groups {
+			r.Queued += g.WaitListSize
+			for _, p := range g.Processes {
+				if p.Sessions > 0 {
+					r.Active++
+				}
+			}
+		}
+	}
+	return s.Max
+}
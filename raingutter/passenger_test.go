@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const passengerStatusXML = `<?xml version="1.0" encoding="iso8859-1" ?>
+<info version="3">
+  <passenger_version>5.3.7</passenger_version>
+  <group_count>2</group_count>
+  <process_count>4</process_count>
+  <max>6</max>
+  <capacity_used>4</capacity_used>
+  <get_wait_list_size>1</get_wait_list_size>
+  <get_wait_list></get_wait_list>
+  <supergroups>
+    <supergroup>
+      <name>/app (production)</name>
+      <state>READY</state>
+      <get_wait_list_size>3</get_wait_list_size>
+      <capacity_used>3</capacity_used>
+      <group default="true">
+        <name>/app (production)</name>
+        <app_root>/app</app_root>
+        <get_wait_list_size>3</get_wait_list_size>
+        <enabled_process_count>3</enabled_process_count>
+        <processes>
+          <process>
+            <pid>101</pid>
+            <sessions>1</sessions>
+            <processed>1200</processed>
+          </process>
+          <process>
+            <pid>102</pid>
+            <sessions>0</sessions>
+            <processed>1100</processed>
+          </process>
+          <process>
+            <pid>103</pid>
+            <sessions>1</sessions>
+            <processed>900</processed>
+          </process>
+        </processes>
+      </group>
+    </supergroup>
+    <supergroup>
+      <name>/admin (production)</name>
+      <state>READY</state>
+      <get_wait_list_size>0</get_wait_list_size>
+      <capacity_used>1</capacity_used>
+      <group default="true">
+        <name>/admin (production) caf` + "\xe9" + `</name>
+        <app_root>/admin</app_root>
+        <get_wait_list_size>0</get_wait_list_size>
+        <enabled_process_count>1</enabled_process_count>
+        <processes>
+          <process>
+            <pid>201</pid>
+            <sessions>2</sessions>
+            <processed>40</processed>
+          </process>
+        </processes>
+      </group>
+    </supergroup>
+  </supergroups>
+</info>
+`
+
+// fakeExecCommand runs TestHelperProcess instead of the command
+func fakeExecCommand(command string, args ...string) *exec.Cmd {
+	cs := append([]string{"-test.run=TestHelperProcess", "--", command}, args...)
+	cmd := exec.Command(os.Args[0], cs...)
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	return cmd
+}
+
+// TestHelperProcess isn't a real test, it fakes passenger-status
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) == 3 && args[1] == "passenger-status" && args[2] == "--show=xml" {
+		fmt.Fprint(os.Stdout, passengerStatusXML)
+		os.Exit(0)
+	}
+	// a stuck instance directory
+	if len(args) == 3 && args[1] == "passenger-status-stuck" {
+		time.Sleep(time.Minute)
+	}
+	fmt.Fprintln(os.Stderr, "ERROR: Phusion Passenger doesn't seem to be running")
+	os.Exit(2)
+}
+
+func TestGetPassengerStatus(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.Command }()
+
+	status, err := GetPassengerStatus("passenger-status", passengerTimeout)
+	if err != nil {
+		t.Fatalf("GetPassengerStatus threw error (%v)", err)
+	}
+	if status.Max != 6 || status.ProcessCount != 4 || status.WaitListSize != 1 || len(status.SuperGroups) != 2 {
+		t.Errorf("GetPassengerStatus: unexpected status %+v", status)
+	}
+	groups := status.SuperGroups[1].Groups
+	if len(groups) != 1 || groups[0].Name != "/admin (production) café" {
+		t.Errorf("expected the group names to be decoded as ISO-8859-1, actual %+v", groups)
+	}
+
+	if _, err := GetPassengerStatus("/usr/local/bin/passenger-status", passengerTimeout); err == nil {
+		t.Errorf("GetPassengerStatus did not raise error when passenger-status failed")
+	}
+
+	start := time.Now()
+	if _, err := GetPassengerStatus("passenger-status-stuck", 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("GetPassengerStatus did not time out (%v)", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("GetPassengerStatus took %v to time out", elapsed)
+	}
+}
+
+func TestParsePassengerStatus(t *testing.T) {
+	for _, invalid := range []string{"", "ERROR: Phusion Passenger doesn't seem to be running", `<?xml version="1.0" encoding="shift_jis" ?><info></info>`} {
+		if _, err := ParsePassengerStatus([]byte(invalid)); err == nil {
+			t.Errorf("ParsePassengerStatus(%v) did not raise error", invalid)
+		}
+	}
+}
+
+func TestScanPassengerStatus(t *testing.T) {
+	status, err := ParsePassengerStatus([]byte(passengerStatusXML))
+	if err != nil {
+		t.Fatalf("ParsePassengerStatus threw error (%v)", err)
+	}
+
+	r := raingutter{Listeners: []listenerStats{{Listener: "stale"}}}
+	capacity := r.ScanPassengerStatus(status)
+	// processes 101, 103 and 201 are processing requests
+	if r.Active != 3 || r.Queued != 4 || capacity != 6 {
+		t.Errorf("ScanPassengerStatus: expected 3 active, 4 queued and a pool of 6, actual %v, %v and %v", r.Active, r.Queued, capacity)
+	}
+	if !reflect.DeepEqual(r.Listeners, []listenerStats{}) {
+		t.Errorf("ScanPassengerStatus: expected no listener, actual %+v", r.Listeners)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -16,15 +17,216 @@ var (
 			Name:       "active",
 			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
 		},
-		[]string{"pod_name", "project", "pod_namespace"})
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
 	raingutterQueued = promauto.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Namespace:  "raingutter",
 			Name:       "queued",
 			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
 		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterOldestConnection = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  "raingutter",
+			Name:       "connection_oldest_seconds",
+			Help:       "Age of the oldest active connection on the listener",
+			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterConnectionLifetime = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "raingutter",
+			Name:      "connection_lifetime_seconds",
+			Help:      "Lifetime of the connections on the listener",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterConnectionRTT = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "raingutter",
+			Name:      "connection_rtt_seconds",
+			Help:      "Smoothed round trip time of the active connections on the listener",
+			Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterConnectionRetransmits = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "raingutter",
+			Name:      "connection_retransmits",
+			Help:      "Segments retransmitted by the active connections on the listener",
+			Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterConnectionLost = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "raingutter",
+			Name:      "connection_lost",
+			Help:      "Segments considered lost by the active connections on the listener",
+			Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterThroughput = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "throughput",
+			Help:      "Connections accepted per second by the listener",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterServiceTime = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "service_time_seconds",
+			Help:      "Mean time a connection stays active, by Little's law",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterWatcherMean = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "watcher_mean",
+			Help:      "Mean of active or queued over the sampling window of Raindrops::Watcher",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener", "kind"})
+	raingutterWatcherStdDev = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "watcher_stddev",
+			Help:      "Standard deviation of active or queued over the sampling window of Raindrops::Watcher",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener", "kind"})
+	raingutterWatcherMax = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "watcher_max",
+			Help:      "Peak of active or queued over the sampling window of Raindrops::Watcher",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener", "kind"})
+	raingutterWatcherLastPeak = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "watcher_last_peak_timestamp_seconds",
+			Help:      "When the peak of active or queued was last reached",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener", "kind"})
+	raingutterBusy = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  "raingutter",
+			Name:       "busy",
+			Help:       "Connections with a request being processed or a response being sent",
+			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterIdle = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  "raingutter",
+			Name:       "idle",
+			Help:       "Keep-alive connections waiting for the next request",
+			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterExcluded = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  "raingutter",
+			Name:       "excluded",
+			Help:       "Connections from the excluded networks, not counted as active",
+			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterQueueLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "queue_limit",
+			Help:      "Maximum size of the accept queue of the listener",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterQueueRatio = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  "raingutter",
+			Name:       "queue_ratio",
+			Help:       "Ratio between queued clients and the accept queue limit",
+			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener"})
+	raingutterConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "connections",
+			Help:      "Number of sockets on the listener in each TCP state",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "listener", "state"})
+	raingutterListenOverflows = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "raingutter",
+			Name:      "listen_overflows_total",
+			Help:      "Times the accept queue of a listener overflowed",
+		},
 		[]string{"pod_name", "project", "pod_namespace"})
-	raingutterWorkers = promauto.NewGaugeVec(
+	raingutterMalformedLines = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "raingutter",
+			Name:      "procfs_malformed_lines_total",
+			Help:      "Lines of /proc/net/tcp and /proc/net/tcp6 which could not be parsed",
+		},
+		[]string{"pod_name", "project", "pod_namespace"})
+	raingutterListenDrops = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "raingutter",
+			Name:      "listen_drops_total",
+			Help:      "Connections dropped by the listeners",
+		},
+		[]string{"pod_name", "project", "pod_namespace"})
+	raingutterPumaWorkerActive = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "worker_active",
+			Help:      "Busy threads of the Puma worker",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "worker_index"})
+	raingutterPumaWorkerQueued = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "worker_queued",
+			Help:      "Requests waiting for a thread of the Puma worker",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "worker_index"})
+	raingutterPumaWorkerCapacity = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "worker_capacity",
+			Help:      "Maximum number of threads of the Puma worker",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "worker_index"})
+	raingutterBusyWorkers = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  "raingutter",
+			Name:       "workers_busy",
+			Help:       "Number of worker processes holding an active connection",
+			Objectives: map[float64]float64{0.0: 0.00, 0.1: 0.01, 0.5: 0.05, 0.95: 0.001, 0.99: 0.001, 1: 1},
+		},
+		[]string{"pod_name", "project", "pod_namespace"})
+	raingutterStuckWorkers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "workers_stuck",
+			Help:      "Number of worker processes holding a connection for longer than the threshold",
+		},
+		[]string{"pod_name", "project", "pod_namespace"})
+	raingutterWorkerBusy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "worker_busy",
+			Help:      "1 if the worker process holds an active connection, 0 otherwise",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "pid"})
+	raingutterWorkerBusyFor = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "raingutter",
+			Name:      "worker_busy_seconds",
+			Help:      "Age of the oldest connection held by the worker process",
+		},
+		[]string{"pod_name", "project", "pod_namespace", "pid"})
+	// pids of the workers of each pod recorded by the previous poll
+	prometheusWorkerPids = map[podInfo]map[string]bool{}
+	raingutterWorkers    = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "raingutter",
 			Name:      "worker",
@@ -39,8 +241,104 @@ var (
 )
 
 func (r *raingutter) recordMetrics(tc *totalConnections, useThreads string) {
-	raingutterActive.WithLabelValues(podName, project, podNameSpace).Observe(r.Active)
-	raingutterQueued.WithLabelValues(podName, project, podNameSpace).Observe(r.Queued)
+	// the labels of the monitored pod, which is not raingutter's own in node mode
+	podName, project, podNameSpace := r.podLabels()
+	if len(r.Listeners) == 0 {
+		raingutterActive.WithLabelValues(podName, project, podNameSpace, "").Observe(r.Active)
+		raingutterQueued.WithLabelValues(podName, project, podNameSpace, "").Observe(r.Queued)
+	}
+	for _, l := range r.Listeners {
+		raingutterActive.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(l.Active)
+		raingutterQueued.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(l.Queued)
+		if l.Throughput != nil {
+			raingutterThroughput.WithLabelValues(podName, project, podNameSpace, l.Listener).Set(l.Throughput.Rate)
+			if l.Throughput.Rate > 0 {
+				raingutterServiceTime.WithLabelValues(podName, project, podNameSpace, l.Listener).Set(l.Throughput.ServiceTime().Seconds())
+			}
+		}
+		if l.Watcher != nil {
+			for _, k := range l.Watcher.kinds() {
+				raingutterWatcherMean.WithLabelValues(podName, project, podNameSpace, l.Listener, k.Name).Set(k.Aggregate.Mean)
+				raingutterWatcherStdDev.WithLabelValues(podName, project, podNameSpace, l.Listener, k.Name).Set(k.Aggregate.StdDev)
+				raingutterWatcherMax.WithLabelValues(podName, project, podNameSpace, l.Listener, k.Name).Set(k.Aggregate.Max)
+				if !k.Aggregate.LastPeakAt.IsZero() {
+					raingutterWatcherLastPeak.WithLabelValues(podName, project, podNameSpace, l.Listener, k.Name).Set(float64(k.Aggregate.LastPeakAt.Unix()))
+				}
+			}
+		}
+		if l.TCPHealth != nil {
+			for _, rtt := range l.TCPHealth.RTTs {
+				raingutterConnectionRTT.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(rtt.Seconds())
+			}
+			for _, retransmits := range l.TCPHealth.Retransmits {
+				raingutterConnectionRetransmits.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(retransmits)
+			}
+			for _, lost := range l.TCPHealth.Lost {
+				raingutterConnectionLost.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(lost)
+			}
+		}
+		if l.Connections != nil {
+			raingutterOldestConnection.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(l.Connections.Oldest.Seconds())
+			for _, lifetime := range l.Connections.Lifetimes {
+				raingutterConnectionLifetime.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(lifetime.Seconds())
+			}
+		}
+		if l.KeepAlive != nil {
+			raingutterBusy.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(l.KeepAlive.Busy)
+			raingutterIdle.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(l.KeepAlive.Idle)
+		}
+		if l.Excluded != nil {
+			raingutterExcluded.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(*l.Excluded)
+		}
+		if l.QueueLimit != 0 {
+			raingutterQueueLimit.WithLabelValues(podName, project, podNameSpace, l.Listener).Set(l.QueueLimit)
+			raingutterQueueRatio.WithLabelValues(podName, project, podNameSpace, l.Listener).Observe(l.queueRatio())
+		}
+		if l.States != nil {
+			for code, count := range l.States {
+				if tcpStateNames[code] != "" {
+					raingutterConnections.WithLabelValues(podName, project, podNameSpace, l.Listener, tcpStateNames[code]).Set(count)
+				}
+			}
+		}
+	}
+	if r.MalformedLines > 0 {
+		raingutterMalformedLines.WithLabelValues(podName, project, podNameSpace).Add(r.MalformedLines)
+	}
+	if r.ListenDrops != nil {
+		raingutterListenOverflows.WithLabelValues(podName, project, podNameSpace).Add(r.ListenDrops.Overflows)
+		raingutterListenDrops.WithLabelValues(podName, project, podNameSpace).Add(r.ListenDrops.Drops)
+	}
+	for _, w := range r.PumaWorkers {
+		index := strconv.Itoa(w.Index)
+		raingutterPumaWorkerActive.WithLabelValues(podName, project, podNameSpace, index).Set(w.Active)
+		raingutterPumaWorkerQueued.WithLabelValues(podName, project, podNameSpace, index).Set(w.Queued)
+		raingutterPumaWorkerCapacity.WithLabelValues(podName, project, podNameSpace, index).Set(w.Capacity)
+	}
+	if r.Workers != nil {
+		raingutterBusyWorkers.WithLabelValues(podName, project, podNameSpace).Observe(busyWorkers(r.Workers))
+		raingutterStuckWorkers.WithLabelValues(podName, project, podNameSpace).Set(stuckWorkers(r.Workers))
+		pids := make(map[string]bool, len(r.Workers))
+		for _, w := range r.Workers {
+			pid := strconv.Itoa(w.Pid)
+			pids[pid] = true
+			busy := 0.0
+			if w.Busy {
+				busy = 1
+			}
+			raingutterWorkerBusy.WithLabelValues(podName, project, podNameSpace, pid).Set(busy)
+			raingutterWorkerBusyFor.WithLabelValues(podName, project, podNameSpace, pid).Set(w.BusyFor.Seconds())
+		}
+		// workers which exited would otherwise be reported forever
+		pod := podInfo{podName, podNameSpace, project}
+		for pid := range prometheusWorkerPids[pod] {
+			if !pids[pid] {
+				raingutterWorkerBusy.DeleteLabelValues(podName, project, podNameSpace, pid)
+				raingutterWorkerBusyFor.DeleteLabelValues(podName, project, podNameSpace, pid)
+			}
+		}
+		prometheusWorkerPids[pod] = pids
+	}
 	if useThreads == "true" {
 		raingutterThreads.WithLabelValues(podName, project, podNameSpace).Set(tc.Count)
 	} else {
@@ -48,6 +346,25 @@ func (r *raingutter) recordMetrics(tc *totalConnections, useThreads string) {
 	}
 }
 
+// deletePodMetrics forgets the metrics of a pod which is not monitored anymore
+func deletePodMetrics(pod podInfo) {
+	labels := prometheus.Labels{"pod_name": pod.Name, "pod_namespace": pod.Namespace}
+	for _, v := range []interface{ DeletePartialMatch(prometheus.Labels) int }{
+		raingutterActive, raingutterQueued, raingutterOldestConnection,
+		raingutterConnectionLifetime, raingutterConnectionRTT, raingutterConnectionRetransmits,
+		raingutterConnectionLost, raingutterThroughput, raingutterServiceTime,
+		raingutterWatcherMean, raingutterWatcherStdDev, raingutterWatcherMax, raingutterWatcherLastPeak, raingutterBusy,
+		raingutterIdle, raingutterExcluded, raingutterQueueLimit, raingutterQueueRatio,
+		raingutterConnections, raingutterListenOverflows, raingutterMalformedLines,
+		raingutterListenDrops, raingutterPumaWorkerActive, raingutterPumaWorkerQueued,
+		raingutterPumaWorkerCapacity, raingutterBusyWorkers, raingutterStuckWorkers,
+		raingutterWorkerBusy, raingutterWorkerBusyFor, raingutterWorkers, raingutterThreads,
+	} {
+		v.DeletePartialMatch(labels)
+	}
+	delete(prometheusWorkerPids, pod)
+}
+
 func setupPrometheus() {
 	go func() {
 		for {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pumaTimeout is how long the control app is given to answer
+const pumaTimeout = 3 * time.Second
+
+// pumaStats is the JSON of the /stats endpoint of the Puma control app. In cluster
+// mode the thread stats are only reported by each worker
+type pumaStats struct {
+	pumaThreadStats
+	WorkerStatus []struct {
+		Index  int  `json:"index"`
+		Pid    int  `json:"pid"`
+		Booted bool `json:"booted"`
+		// empty until the worker checks in with the master
+		LastStatus pumaThreadStats `json:"last_status"`
+	} `json:"worker_status"`
+}
+
+// pumaThreadStats holds the thread pool stats of a single mode server or a worker
+type pumaThreadStats struct {
+	// requests waiting for a thread
+	Backlog float64 `json:"backlog"`
+	// threads spawned
+	Running float64 `json:"running"`
+	// requests which can be processed right away: idle threads plus the ones
+	// which can still be spawned
+	PoolCapacity float64 `json:"pool_capacity"`
+	MaxThreads   float64 `json:"max_threads"`
+}
+
+// busy returns the number of threads processing a request
+func (s pumaThreadStats) busy() float64 {
+	return s.MaxThreads - s.PoolCapacity
+}
+
+// pumaWorkerStats holds the stats of a worker of a cluster mode server
+type pumaWorkerStats struct {
+	Index    int
+	Active   float64
+	Queued   float64
+	Capacity float64
+}
+
+// pumaControl reads the stats of a Puma server from its control app
+type pumaControl struct {
+	Client http.Client
+	// the /stats endpoint, eg: http://127.0.0.1:9293/stats
+	URL   string
+	Token string
+}
+
+// newPumaControl returns a client of the control app listening on rawURL, as passed to
+// Puma's --control-url: tcp://<host>:<port> or unix://<socket path>. The http(s) and
+// unix URLs of Raindrops are supported too, see newRaindropsClient
+func newPumaControl(rawURL string, token string, opts raindropsOptions) (*pumaControl, error) {
+	if hostPort, ok := strings.CutPrefix(rawURL, "tcp://"); ok {
+		rawURL = "http://" + hostPort
+	}
+	client, u, err := newRaindropsClient(rawURL, "", opts)
+	if err != nil {
+		return nil, err
+	}
+	return &pumaControl{Client: client, URL: strings.TrimSuffix(u, "/") + "/stats", Token: token}, nil
+}
+
+// Stats fetches the stats of the server
+func (p *pumaControl) Stats() (pumaStats, error) {
+	u := p.URL
+	if p.Token != "" {
+		u += "?" + url.Values{"token": {p.Token}}.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return pumaStats{}, err
+	}
+	req.Header.Set("User-Agent", "raingutter")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return pumaStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// the token is not logged
+		return pumaStats{}, errors.New("puma control app return code is: " + resp.Status)
+	}
+
+	var stats pumaStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return pumaStats{}, err
+	}
+	return stats, nil
+}
+
+// maxThreads returns the number of threads of the server, summed across the booted
+// workers in cluster mode
+func (s pumaStats) maxThreads() float64 {
+	if len(s.WorkerStatus) == 0 {
+		return s.MaxThreads
+	}
+	var threads float64
+	for _, w := range s.WorkerStatus {
+		if w.Booted {
+			threads += w.LastStatus.MaxThreads
+		}
+	}
+	return threads
+}
+
+// ScanPumaStats maps the stats of a Puma server to raingutter: active is the number of
+// busy threads and queued the requests waiting for a thread, summed across the workers
+// in cluster mode. It returns the number of threads, which is the capacity
+func (r *raingutter) ScanPumaStats(s pumaStats) float64 {
+	r.Listeners = r.Listeners[:0]
+	r.PumaWorkers = r.PumaWorkers[:0]
+	if len(s.WorkerStatus) == 0 {
+		r.Active = s.busy()
+		r.Queued = s.Backlog
+		return s.maxThreads()
+	}
+
+	r.Active = 0
+	r.Queued = 0
+	for _, w := range s.WorkerStatus {
+		if !w.Booted {
+			continue
+		}
+		r.PumaWorkers = append(r.PumaWorkers, pumaWorkerStats{
+			Index:    w.Index,
+			Active:   w.LastStatus.busy(),
+			Queued:   w.LastStatus.Backlog,
+			Capacity: w.LastStatus.MaxThreads,
+		})
+		r.Active += w.LastStatus.busy()
+		r.Queued += w.LastStatus.Backlog
+	}
+	return s.maxThreads()
+}
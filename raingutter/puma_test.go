@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const pumaSingleStats = `{"started_at":"2023-03-14T09:26:53Z","backlog":2,"running":5,"pool_capacity":1,"max_threads":5,"requests_count":1200}`
+
+const pumaClusterStats = `{"started_at":"2023-03-14T09:26:53Z","workers":3,"phase":0,"booted_workers":2,"old_workers":0,"worker_status":[
+{"started_at":"2023-03-14T09:26:54Z","pid":101,"index":0,"phase":0,"booted":true,"last_checkin":"2023-03-14T09:27:00Z","last_status":{"backlog":0,"running":5,"pool_capacity":2,"max_threads":5,"requests_count":600}},
+{"started_at":"2023-03-14T09:26:54Z","pid":102,"index":1,"phase":0,"booted":true,"last_checkin":"2023-03-14T09:27:00Z","last_status":{"backlog":3,"running":5,"pool_capacity":0,"max_threads":5,"requests_count":600}},
+{"started_at":"2023-03-14T09:27:01Z","pid":103,"index":2,"phase":0,"booted":false,"last_checkin":"2023-03-14T09:27:01Z","last_status":{}}]}`
+
+// pumaHandler answers like the Puma control app, with the given stats
+func pumaHandler(stats string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stats" || r.URL.Query().Get("token") != "s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, stats)
+	})
+}
+
+func TestPumaControlStats(t *testing.T) {
+	ts := httptest.NewServer(pumaHandler(pumaSingleStats))
+	defer ts.Close()
+
+	p, err := newPumaControl("tcp://"+strings.TrimPrefix(ts.URL, "http://"), "s3cr3t", raindropsOptions{Timeout: pumaTimeout})
+	if err != nil {
+		t.Fatalf("newPumaControl threw error (%v)", err)
+	}
+	actual, err := p.Stats()
+	if err != nil {
+		t.Fatalf("Stats threw error (%v)", err)
+	}
+	expected := pumaStats{pumaThreadStats: pumaThreadStats{Backlog: 2, Running: 5, PoolCapacity: 1, MaxThreads: 5}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Stats: expected %+v, actual %+v", expected, actual)
+	}
+
+	p.Token = "invalid"
+	if _, err := p.Stats(); err == nil {
+		t.Errorf("Stats did not raise error with an invalid token")
+	}
+}
+
+func TestPumaControlUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "pumactl.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(pumaHandler(pumaClusterStats))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	p, err := newPumaControl("unix://"+socket, "s3cr3t", raindropsOptions{Timeout: pumaTimeout})
+	if err != nil {
+		t.Fatalf("newPumaControl threw error (%v)", err)
+	}
+	stats, err := p.Stats()
+	if err != nil {
+		t.Fatalf("Stats threw error (%v)", err)
+	}
+	if len(stats.WorkerStatus) != 3 || stats.WorkerStatus[1].LastStatus.Backlog != 3 {
+		t.Errorf("expected the stats of 3 workers, actual %+v", stats)
+	}
+}
+
+func TestScanPumaStats(t *testing.T) {
+	ts := httptest.NewServer(pumaHandler(pumaClusterStats))
+	defer ts.Close()
+	p, _ := newPumaControl(ts.URL, "s3cr3t", raindropsOptions{Timeout: pumaTimeout})
+	cluster, err := p.Stats()
+	if err != nil {
+		t.Fatalf("Stats threw error (%v)", err)
+	}
+
+	r := raingutter{}
+	capacity := r.ScanPumaStats(cluster)
+	expected := []pumaWorkerStats{
+		{Index: 0, Active: 3, Queued: 0, Capacity: 5},
+		{Index: 1, Active: 5, Queued: 3, Capacity: 5},
+	}
+	if !reflect.DeepEqual(r.PumaWorkers, expected) {
+		t.Errorf("ScanPumaStats: expected %+v, actual %+v", expected, r.PumaWorkers)
+	}
+	// the worker which is not booted yet is skipped
+	if r.Active != 8 || r.Queued != 3 || capacity != 10 {
+		t.Errorf("ScanPumaStats: expected 8 active, 3 queued and 10 threads, actual %v, %v and %v", r.Active, r.Queued, capacity)
+	}
+
+	single := pumaStats{pumaThreadStats: pumaThreadStats{Backlog: 2, Running: 5, PoolCapacity: 1, MaxThreads: 5}}
+	capacity = r.ScanPumaStats(single)
+	if r.Active != 4 || r.Queued != 2 || capacity != 5 || len(r.PumaWorkers) != 0 {
+		t.Errorf("ScanPumaStats: expected 4 active, 2 queued and 5 threads, actual %v, %v and %v", r.Active, r.Queued, capacity)
+	}
+}
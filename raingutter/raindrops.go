@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultRaindropsPath is where the Raindrops middleware answers by default
+const defaultRaindropsPath = "/_raindrops"
+
+// raindropsOptions configures how the Raindrops endpoint is fetched
+type raindropsOptions struct {
+	Timeout time.Duration
+	// sent with every request, overriding the default User-Agent if set
+	Header http.Header
+	// basic auth, takes precedence over Token
+	Username string
+	Password string
+	// bearer token
+	Token string
+	// PEM bundle of the CAs trusted for https URLs, the system ones when empty
+	CAFile string
+}
+
+// newRaindropsClient returns the client and the URL to request for rawURL, which is
+// either an http(s) URL or unix://<socket path>[:<request path>], eg:
+// unix:///var/run/unicorn.sock:/_raindrops. The request path defaults to defaultPath
+func newRaindropsClient(rawURL string, defaultPath string, opts raindropsOptions) (http.Client, string, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return http.Client{}, "", err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return http.Client{}, "", errors.New("no certificate found in " + opts.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	url := rawURL
+	if socket, ok := strings.CutPrefix(rawURL, "unix://"); ok {
+		socket, path, _ := strings.Cut(socket, ":")
+		if socket == "" {
+			return http.Client{}, "", errors.New("missing socket path in " + rawURL)
+		}
+		if path == "" {
+			path = defaultPath
+		}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		// the host is only used for the Host header
+		url = "http://localhost" + path
+	}
+
+	client := http.Client{
+		Timeout: opts.Timeout,
+		Transport: &headerTransport{
+			next:     transport,
+			header:   opts.Header,
+			username: opts.Username,
+			password: opts.Password,
+			token:    opts.Token,
+		},
+	}
+	return client, url, nil
+}
+
+// headerTransport adds the configured headers and credentials to every request
+type headerTransport struct {
+	next     http.RoundTripper
+	header   http.Header
+	username string
+	password string
+	token    string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request of the caller
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	} else if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// parseHeaders parses `Name: value` headers, one per line: unlike a comma, a newline
+// can't be part of the value of a header
+func parseHeaders(s string) (http.Header, error) {
+	header := http.Header{}
+	for _, h := range strings.Split(s, "\n") {
+		if strings.TrimSpace(h) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, errors.New("invalid header: " + h)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	actual, err := parseHeaders("X-Forwarded-Proto: https\r\n user-agent:datadog \nAccept: text/plain, */*\n")
+	if err != nil {
+		t.Fatalf("parseHeaders threw error (%v)", err)
+	}
+	expected := http.Header{"X-Forwarded-Proto": {"https"}, "User-Agent": {"datadog"}, "Accept": {"text/plain, */*"}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("parseHeaders: expected %v, actual %v", expected, actual)
+	}
+
+	for _, invalid := range []string{"X-Forwarded-Proto", ": https"} {
+		if _, err := parseHeaders(invalid); err == nil {
+			t.Errorf("parseHeaders(%v) did not raise error", invalid)
+		}
+	}
+}
+
+// raindropsHandler answers like the Raindrops middleware, recording the requests
+func raindropsHandler(requests *[]*http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		fmt.Fprint(w, RdOut[0].n)
+	})
+}
+
+func TestRaindropsClientUnixSocket(t *testing.T) {
+	var requests []*http.Request
+	socket := filepath.Join(t.TempDir(), "unicorn.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(raindropsHandler(&requests))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	opts := raindropsOptions{
+		Header:   http.Header{"User-Agent": {"datadog"}, "X-Forwarded-Proto": {"https"}},
+		Username: "raingutter",
+		Password: "s3cr3t",
+		Token:    "ignored",
+	}
+	for _, rawURL := range []string{"unix://" + socket, "unix://" + socket + ":/_raindrops"} {
+		c, url, err := newRaindropsClient(rawURL, defaultRaindropsPath, opts)
+		if err != nil {
+			t.Fatalf("newRaindropsClient(%v) threw error (%v)", rawURL, err)
+		}
+		s := status{Ready: true}
+		r := raingutter{}
+		r.Scan(Fetch(c, url, &s), false)
+		if r.Active != 3 || r.Queued != 4 {
+			t.Errorf("%v: expected 3 active and 4 queued, actual %+v", rawURL, r)
+		}
+	}
+
+	for _, req := range requests {
+		username, password, _ := req.BasicAuth()
+		switch {
+		case req.URL.Path != "/_raindrops":
+			t.Errorf("path is %v expecting /_raindrops", req.URL.Path)
+		case req.UserAgent() != "datadog" || req.Header.Get("X-Forwarded-Proto") != "https":
+			t.Errorf("expected the configured headers, actual %v", req.Header)
+		case username != "raingutter" || password != "s3cr3t":
+			t.Errorf("expected basic auth, actual %v", req.Header.Get("Authorization"))
+		}
+	}
+
+	if _, _, err := newRaindropsClient("unix://:/_raindrops", defaultRaindropsPath, opts); err == nil {
+		t.Errorf("newRaindropsClient did not raise error without a socket path")
+	}
+}
+
+func TestRaindropsClientTLS(t *testing.T) {
+	var requests []*http.Request
+	ts := httptest.NewTLSServer(raindropsHandler(&requests))
+	defer ts.Close()
+
+	// the certificate of the test server is self-signed
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, url, err := newRaindropsClient(ts.URL+"/_raindrops", "", raindropsOptions{CAFile: caFile, Token: "s3cr3t"})
+	if err != nil {
+		t.Fatalf("newRaindropsClient threw error (%v)", err)
+	}
+	s := status{Ready: true}
+	if res := Fetch(c, url, &s); res == nil {
+		t.Fatalf("could not fetch %v with the custom CA", url)
+	} else {
+		res.Body.Close()
+	}
+	if len(requests) != 1 || requests[0].Header.Get("Authorization") != "Bearer s3cr3t" {
+		t.Errorf("expected a bearer token, actual %v", requests)
+	}
+
+	// the system CAs don't trust the test server
+	c, url, _ = newRaindropsClient(ts.URL+"/_raindrops", "", raindropsOptions{})
+	if res := Fetch(c, url, &s); res != nil {
+		t.Errorf("fetched %v without the custom CA", url)
+	}
+
+	if _, _, err := newRaindropsClient(ts.URL, "", raindropsOptions{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Errorf("newRaindropsClient did not raise error with a missing CA file")
+	}
+}
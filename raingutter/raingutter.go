@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -31,6 +34,54 @@ type raingutter struct {
 	Writing float64
 	Active  float64
 	Queued  float64
+	// per listener stats, populated by the built in socket monitoring and Raindrops
+	Listeners []listenerStats
+	// connections refused by the kernel since the previous poll, nil when disabled
+	ListenDrops *ListenDrops
+	// stats of each worker of a Puma cluster, only populated by the Puma collector
+	PumaWorkers []pumaWorkerStats
+	// busy state of the worker processes, nil when disabled
+	Workers []workerStats
+	// lines of /proc/net/tcp{,6} which could not be parsed by the last poll
+	MalformedLines float64
+	// the pod the stats come from in node mode, raingutter's own pod when nil
+	Pod *podInfo
+}
+
+// podLabels returns the name, project and namespace of the pod the stats come from
+func (r *raingutter) podLabels() (string, string, string) {
+	if r.Pod == nil {
+		return podName, project, podNameSpace
+	}
+	return r.Pod.Name, r.Pod.Project, r.Pod.Namespace
+}
+
+// newStatsdTags returns the tags added to every statsd metric: the k8s tags of
+// raingutter's own pod followed by RG_STATSD_EXTRA_TAGS. In node mode the k8s tags are
+// the ones of the monitored pods, added by podStatsdClient
+func newStatsdTags(nodeMode bool, extraTags string) []string {
+	var tags []string
+
+	// Add k8s tags
+	if !nodeMode {
+		if podName != "" {
+			tags = append(tags, "pod_name:"+podName)
+		}
+
+		if podNameSpace != "" {
+			tags = append(tags, "pod_namespace:"+podNameSpace)
+		}
+
+		if project != "" {
+			tags = append(tags, "project:"+project)
+		}
+	}
+
+	// Add extra tags
+	if extraTags != "" {
+		tags = append(tags, strings.Split(extraTags, ",")...)
+	}
+	return tags
 }
 
 type status struct {
@@ -53,30 +104,6 @@ func checkFatal(err error) {
 	}
 }
 
-func getThreads(tc *totalConnections) {
-	var (
-		threads float64
-	)
-	maxThreads := os.Getenv("MAX_THREADS")
-	if maxThreads == "" {
-		log.Fatal("MAX_THREADS is not defined.")
-	}
-	threads, err := strconv.ParseFloat(maxThreads, 64)
-	checkFatal(err)
-	tc.Count = threads
-}
-
-func getWorkers(tc *totalConnections) {
-	var (
-		workers float64
-		err     error
-	)
-	unicornWorkers := os.Getenv("UNICORN_WORKERS")
-	workers, err = strconv.ParseFloat(unicornWorkers, 64)
-	checkFatal(err)
-	tc.Count = workers
-}
-
 // Fetch the raindrops output and convert it to a slice on strings
 func Fetch(c http.Client, url string, s *status) *http.Response {
 	request, err := http.NewRequest("GET", url, nil)
@@ -113,27 +140,72 @@ func Parse(l string) float64 {
 	return value
 }
 
-func (r *raingutter) Scan(response *http.Response) raingutter {
+// Scan reads the Raindrops middleware output, which reports active and queued
+// for each listener of the app:
+// calling: int
+// writing: int
+// <UNIX or TCP SOCKET> active: int
+// <UNIX or TCP SOCKET> queued: int
+// Active and Queued are the sum of all listeners, which is also reported as the
+// `total` listener if enabled
+func (r *raingutter) Scan(response *http.Response, total bool) raingutter {
 	scanner := bufio.NewScanner(response.Body)
 	defer response.Body.Close()
+
+	r.Active = 0
+	r.Queued = 0
+	r.Listeners = r.Listeners[:0]
 	for scanner.Scan() {
 		l := scanner.Text()
+		// listener addresses contain colons too, eg: 127.0.0.1:3000 active: 3
+		i := strings.LastIndex(l, ":")
+		if i < 0 {
+			continue
+		}
+		name := strings.TrimSpace(l[:i])
 		switch {
-		case strings.Contains(l, "active"):
-			r.Active = Parse(l)
-		case strings.Contains(l, "writing"):
+		case name == "writing":
 			r.Writing = Parse(l)
-		case strings.Contains(l, "calling"):
+		case name == "calling":
 			r.Calling = Parse(l)
-		case strings.Contains(l, "queued"):
-			r.Queued = Parse(l)
+		case strings.HasSuffix(name, " active"):
+			ls := r.raindropsListener(strings.TrimSuffix(name, " active"))
+			ls.Active = Parse(l)
+			r.Active += ls.Active
+		case strings.HasSuffix(name, " queued"):
+			ls := r.raindropsListener(strings.TrimSuffix(name, " queued"))
+			ls.Queued = Parse(l)
+			r.Queued += ls.Queued
 		default:
 			continue
 		}
 	}
+	if total && len(r.Listeners) > 0 {
+		r.Listeners = append(r.Listeners, listenerStats{Listener: "total", Active: r.Active, Queued: r.Queued})
+	}
 	return *r
 }
 
+// raindropsListener returns the stats of the listener at address, which are added
+// the first time it shows up
+func (r *raingutter) raindropsListener(address string) *listenerStats {
+	if ls := r.listener(address); ls != nil {
+		return ls
+	}
+	r.Listeners = append(r.Listeners, listenerStats{Listener: address})
+	return &r.Listeners[len(r.Listeners)-1]
+}
+
+// listener returns the stats of the listener at address, nil if it is unknown
+func (r *raingutter) listener(address string) *listenerStats {
+	for i := range r.Listeners {
+		if r.Listeners[i].Listener == address {
+			return &r.Listeners[i]
+		}
+	}
+	return nil
+}
+
 func (r *raingutter) ScanSocketStats(s *SocketStats) raingutter {
 	// `writing` and `calling` are not yet implemented
 	r.Active = s.ActiveWorkers
@@ -141,6 +213,195 @@ func (r *raingutter) ScanSocketStats(s *SocketStats) raingutter {
 	return *r
 }
 
+// ScanListenersSocketStats records the stats of each listener and their sum in
+// Active and Queued. The sum is also reported as the `total` listener if enabled
+func (r *raingutter) ScanListenersSocketStats(listeners []listener, stats []*SocketStats, opts socketStatsOptions) raingutter {
+	r.Active = 0
+	r.Queued = 0
+	r.Listeners = r.Listeners[:0]
+	total := listenerStats{Listener: "total"}
+	for i, l := range listeners {
+		ls := listenerStats{
+			Listener: l.String(),
+			Active:   stats[i].ActiveWorkers,
+			Queued:   stats[i].QueueSize,
+		}
+		// idle keep-alive connections can only be told apart with their tcp_info
+		if stats[i].HasTCPInfo {
+			busy := stats[i].ActiveWorkers - stats[i].IdleWorkers
+			if opts.ActiveBusyOnly {
+				ls.Active = busy
+			}
+			if opts.KeepAlive {
+				ls.KeepAlive = &keepAliveStats{Busy: busy, Idle: stats[i].IdleWorkers}
+				if total.KeepAlive == nil {
+					total.KeepAlive = &keepAliveStats{}
+				}
+				total.KeepAlive.Busy += busy
+				total.KeepAlive.Idle += stats[i].IdleWorkers
+			}
+			if opts.TCPHealth {
+				ls.TCPHealth = &tcpHealthStats{}
+				if total.TCPHealth == nil {
+					total.TCPHealth = &tcpHealthStats{}
+				}
+				for _, info := range stats[i].ActiveInfos {
+					ls.TCPHealth.add(info)
+					total.TCPHealth.add(info)
+				}
+			}
+		}
+		r.Active += ls.Active
+		r.Queued += ls.Queued
+		if opts.QueueLimit {
+			ls.QueueLimit = stats[i].QueueLimit
+			total.QueueLimit += ls.QueueLimit
+		}
+		if opts.Excluded && l.Path == "" {
+			excluded := stats[i].ExcludedWorkers
+			ls.Excluded = &excluded
+			if total.Excluded == nil {
+				total.Excluded = new(float64)
+			}
+			*total.Excluded += excluded
+		}
+
+		// TCP states don't apply to unix domain sockets
+		if opts.TCPStates && l.Path == "" {
+			states := stats[i].States
+			ls.States = &states
+			if total.States == nil {
+				total.States = &TCPStates{}
+			}
+			for code, count := range states {
+				total.States[code] += count
+			}
+		}
+		r.Listeners = append(r.Listeners, ls)
+	}
+	if opts.Total {
+		total.Active = r.Active
+		total.Queued = r.Queued
+		r.Listeners = append(r.Listeners, total)
+	}
+	return *r
+}
+
+// collectSocketStats retrieves the socket stats of each listener in the network namespace
+// of target with the configured collector. Unix domain sockets are always read from
+// procfs. If netlink is not allowed in this environment, the collector is
+// switched to procfs for good
+func collectSocketStats(collector *string, target *targetProcess, tables *socketTableReader, listeners []listener, opts socketStatsOptions) ([]*SocketStats, error) {
+	var tcpListeners []listener
+	stats := make([]*SocketStats, len(listeners))
+
+	var rawUnixStats string
+	unixRead := false
+	for i, l := range listeners {
+		if l.Path == "" {
+			tcpListeners = append(tcpListeners, l)
+			continue
+		}
+		// an unreadable table is not an idle app
+		if !unixRead {
+			var err error
+			rawUnixStats, err = GetUnixSocketStats(target.netDir())
+			if err != nil {
+				return nil, err
+			}
+			unixRead = true
+		}
+		s, err := ParseUnixSocketStats(l.Path, rawUnixStats)
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = s
+	}
+
+	if len(tcpListeners) > 0 {
+		tcpStats, err := collectTCPSocketStats(collector, target, tables, tcpListeners, opts.ExcludedNets)
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range listeners {
+			if l.Path == "" {
+				stats[i], tcpStats = tcpStats[0], tcpStats[1:]
+			}
+		}
+	}
+
+	// only inet_diag reports the backlog of the listeners. somaxconn is read from
+	// the namespace of raingutter, which may differ from the one of the target
+	if opts.QueueLimit {
+		var somaxconn float64
+		for _, s := range stats {
+			if s.QueueLimit != 0 {
+				continue
+			}
+			if somaxconn == 0 {
+				var err error
+				somaxconn, err = GetSomaxconn(target.procRoot())
+				if err != nil {
+					log.Error(err)
+					break
+				}
+			}
+			s.QueueLimit = queueLimit(opts.ListenBacklog, somaxconn)
+		}
+	}
+
+	return stats, nil
+}
+
+// collectTCPSocketStats retrieves the socket stats of each TCP listener
+func collectTCPSocketStats(collector *string, target *targetProcess, tables *socketTableReader, listeners []listener, excluded excludedNets) ([]*SocketStats, error) {
+	if *collector == "netlink" {
+		stats := make([]*SocketStats, 0, len(listeners))
+		for _, l := range listeners {
+			s, err := GetNetlinkSocketStats(l, excluded, target.netns())
+			if err == nil {
+				stats = append(stats, s)
+				continue
+			}
+			if !netlinkDenied(err) {
+				return nil, err
+			}
+			log.Warning("netlink socket stats are not available, falling back to procfs: ", err)
+			*collector = "procfs"
+			break
+		}
+		if *collector == "netlink" {
+			return stats, nil
+		}
+	}
+
+	return tables.ReadListenersSocketStats(target.netDir(), listeners, excluded)
+}
+
+// collectWorkers attributes the active connections of every listener to the worker
+// processes holding them. Only the processes in pids are considered, unless nil
+func collectWorkers(tracker *workerTracker, procRoot string, pattern *regexp.Regexp, pids map[int]bool, stats []*SocketStats) []workerStats {
+	workers, err := GetWorkerProcesses(procRoot, pattern)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if pids != nil {
+		var own []workerProcess
+		for _, w := range workers {
+			if pids[w.Pid] {
+				own = append(own, w)
+			}
+		}
+		workers = own
+	}
+	var activeInodes []string
+	for _, s := range stats {
+		activeInodes = append(activeInodes, s.ActiveInodes...)
+	}
+	return tracker.update(workers, activeInodes, time.Now())
+}
+
 // The histogram interface calculates the statistical distribution of any kind of value
 // and it generates:
 //  - 95percentile,
@@ -152,7 +413,7 @@ func (r *raingutter) ScanSocketStats(s *SocketStats) raingutter {
 // according to what's specified in /etc/dd-agent/datadog.conf
 //
 // https://docs.datadoghq.com/guides/dogstatsd/
-func (r *raingutter) sendStats(c *statsd.Client, tc *totalConnections, useThreads string) {
+func (r *raingutter) sendStats(c statsd.ClientInterface, tc *totalConnections, useThreads string) {
 	// calling: int
 	// writing: int
 	//
@@ -166,12 +427,154 @@ func (r *raingutter) sendStats(c *statsd.Client, tc *totalConnections, useThread
 	// writing - the number of clients being written to on your machine
 	err = c.Histogram("writing", r.Writing, nil, 1)
 	checkError(err)
-	// queued - total number of queued (pre-accept()) clients on that listener
-	err = c.Histogram("queued", r.Queued, nil, 1)
-	checkError(err)
-	// active - total number of active clients on that listener
-	err = c.Histogram("active", r.Active, nil, 1)
-	checkError(err)
+	if len(r.Listeners) == 0 {
+		// queued - total number of queued (pre-accept()) clients on that listener
+		err = c.Histogram("queued", r.Queued, nil, 1)
+		checkError(err)
+		// active - total number of active clients on that listener
+		err = c.Histogram("active", r.Active, nil, 1)
+		checkError(err)
+	}
+	for _, l := range r.Listeners {
+		tags := []string{"listener:" + l.Listener}
+		err = c.Histogram("queued", l.Queued, tags, 1)
+		checkError(err)
+		err = c.Histogram("active", l.Active, tags, 1)
+		checkError(err)
+		if l.Throughput != nil {
+			// throughput - connections accepted per second
+			err = c.Histogram("throughput", l.Throughput.Rate, tags, 1)
+			checkError(err)
+			// service_time - mean time in seconds a connection stays active, by Little's law
+			if l.Throughput.Rate > 0 {
+				err = c.Histogram("service_time", l.Throughput.ServiceTime().Seconds(), tags, 1)
+				checkError(err)
+			}
+		}
+		if l.Watcher != nil {
+			now := time.Now()
+			for _, k := range l.Watcher.kinds() {
+				// watcher.<active|queued>.mean - mean over the sampling window of Raindrops::Watcher
+				err = c.Histogram("watcher."+k.Name+".mean", k.Aggregate.Mean, tags, 1)
+				checkError(err)
+				// watcher.<active|queued>.stddev - standard deviation over the sampling window
+				err = c.Histogram("watcher."+k.Name+".stddev", k.Aggregate.StdDev, tags, 1)
+				checkError(err)
+				// watcher.<active|queued>.max - peak over the sampling window, even between two polls
+				err = c.Histogram("watcher."+k.Name+".max", k.Aggregate.Max, tags, 1)
+				checkError(err)
+				// watcher.<active|queued>.peak_age - seconds since the peak was last reached
+				if !k.Aggregate.LastPeakAt.IsZero() {
+					err = c.Histogram("watcher."+k.Name+".peak_age", k.Aggregate.peakAge(now).Seconds(), tags, 1)
+					checkError(err)
+				}
+			}
+		}
+		if l.TCPHealth != nil {
+			// connection.rtt - smoothed round trip time in seconds of each active connection
+			for _, rtt := range l.TCPHealth.RTTs {
+				err = c.Histogram("connection.rtt", rtt.Seconds(), tags, 1)
+				checkError(err)
+			}
+			// connection.retransmits - segments retransmitted by each active connection
+			for _, retransmits := range l.TCPHealth.Retransmits {
+				err = c.Histogram("connection.retransmits", retransmits, tags, 1)
+				checkError(err)
+			}
+			// connection.lost - segments currently considered lost by each active connection
+			for _, lost := range l.TCPHealth.Lost {
+				err = c.Histogram("connection.lost", lost, tags, 1)
+				checkError(err)
+			}
+		}
+		if l.Connections != nil {
+			// connection.oldest - age in seconds of the oldest active connection
+			err = c.Histogram("connection.oldest", l.Connections.Oldest.Seconds(), tags, 1)
+			checkError(err)
+			// connection.lifetime - lifetime in seconds of the connections closed since the previous poll
+			for _, lifetime := range l.Connections.Lifetimes {
+				err = c.Histogram("connection.lifetime", lifetime.Seconds(), tags, 1)
+				checkError(err)
+			}
+		}
+		if l.KeepAlive != nil {
+			// busy - connections with a request being processed or a response being sent
+			err = c.Histogram("busy", l.KeepAlive.Busy, tags, 1)
+			checkError(err)
+			// idle - keep-alive connections waiting for the next request
+			err = c.Histogram("idle", l.KeepAlive.Idle, tags, 1)
+			checkError(err)
+		}
+		if l.Excluded != nil {
+			// excluded - connections from the excluded networks, not counted as active
+			err = c.Histogram("excluded", *l.Excluded, tags, 1)
+			checkError(err)
+		}
+		if l.QueueLimit != 0 {
+			// queue.limit - maximum number of queued clients before the kernel drops connections
+			err = c.Histogram("queue.limit", l.QueueLimit, tags, 1)
+			checkError(err)
+			// queue.ratio - how full the accept queue is
+			err = c.Histogram("queue.ratio", l.queueRatio(), tags, 1)
+			checkError(err)
+		}
+		if l.States != nil {
+			// connections - number of sockets on that listener in each TCP state
+			for code, count := range l.States {
+				if tcpStateNames[code] == "" {
+					continue
+				}
+				err = c.Histogram("connections", count, append(tags, "state:"+tcpStateNames[code]), 1)
+				checkError(err)
+			}
+		}
+	}
+	if r.MalformedLines > 0 {
+		// procfs.malformed_lines - lines of /proc/net/tcp{,6} which could not be parsed
+		err = c.Count("procfs.malformed_lines", int64(r.MalformedLines), nil, 1)
+		checkError(err)
+	}
+	if r.ListenDrops != nil {
+		// listen.overflows - times an accept queue overflowed since the previous poll
+		err = c.Count("listen.overflows", int64(r.ListenDrops.Overflows), nil, 1)
+		checkError(err)
+		// listen.drops - connections dropped by the listeners since the previous poll
+		err = c.Count("listen.drops", int64(r.ListenDrops.Drops), nil, 1)
+		checkError(err)
+	}
+	for _, w := range r.PumaWorkers {
+		tags := []string{"worker_index:" + strconv.Itoa(w.Index)}
+		// worker.active - busy threads of the Puma worker
+		err = c.Histogram("worker.active", w.Active, tags, 1)
+		checkError(err)
+		// worker.queued - requests waiting for a thread of the Puma worker
+		err = c.Histogram("worker.queued", w.Queued, tags, 1)
+		checkError(err)
+		// worker.capacity - maximum number of threads of the Puma worker
+		err = c.Histogram("worker.capacity", w.Capacity, tags, 1)
+		checkError(err)
+	}
+	if r.Workers != nil {
+		// workers.busy - number of worker processes holding an active connection
+		err = c.Histogram("workers.busy", busyWorkers(r.Workers), nil, 1)
+		checkError(err)
+		// workers.stuck - number of worker processes holding a connection for too long
+		err = c.Histogram("workers.stuck", stuckWorkers(r.Workers), nil, 1)
+		checkError(err)
+		for _, w := range r.Workers {
+			tags := []string{"worker_pid:" + strconv.Itoa(w.Pid)}
+			busy := 0.0
+			if w.Busy {
+				busy = 1
+			}
+			// worker.busy - 1 if the worker holds an active connection, 0 otherwise
+			err = c.Gauge("worker.busy", busy, tags, 1)
+			checkError(err)
+			// worker.busy_for - age in seconds of the oldest connection held by the worker
+			err = c.Gauge("worker.busy_for", w.BusyFor.Seconds(), tags, 1)
+			checkError(err)
+		}
+	}
 	if useThreads == "true" {
 		// threads.count - total number of allowed threads
 		err = c.Histogram("threads.count", tc.Count, nil, 1)
@@ -184,14 +587,101 @@ func (r *raingutter) sendStats(c *statsd.Client, tc *totalConnections, useThread
 }
 
 func (r *raingutter) logMetrics(tc *totalConnections, raindropsURL string) {
-	contextLogger := log.WithFields(log.Fields{
+	fields := log.Fields{
 		"active":  r.Active,
 		"queued":  r.Queued,
 		"writing": r.Writing,
 		"calling": r.Calling,
 		"workers": tc.Count,
-	})
+	}
+	if r.Workers != nil {
+		fields["busy_workers"] = busyWorkers(r.Workers)
+		fields["stuck_workers"] = stuckWorkers(r.Workers)
+	}
+	if r.MalformedLines > 0 {
+		fields["malformed_lines"] = r.MalformedLines
+	}
+	if r.Pod != nil {
+		fields["pod_name"] = r.Pod.Name
+		fields["pod_namespace"] = r.Pod.Namespace
+		fields["project"] = r.Pod.Project
+	}
+	if r.ListenDrops != nil {
+		fields["listen_overflows"] = r.ListenDrops.Overflows
+		fields["listen_drops"] = r.ListenDrops.Drops
+	}
+	contextLogger := log.WithFields(fields)
 	contextLogger.Info(raindropsURL)
+
+	for _, l := range r.Listeners {
+		fields := log.Fields{
+			"listener": l.Listener,
+			"active":   l.Active,
+			"queued":   l.Queued,
+		}
+		if r.Pod != nil {
+			fields["pod_name"] = r.Pod.Name
+			fields["pod_namespace"] = r.Pod.Namespace
+			fields["project"] = r.Pod.Project
+		}
+		if l.Throughput != nil {
+			fields["throughput"] = l.Throughput.Rate
+			fields["service_time"] = l.Throughput.ServiceTime().Seconds()
+		}
+		if l.Watcher != nil {
+			for _, k := range l.Watcher.kinds() {
+				fields["watcher_"+k.Name+"_mean"] = k.Aggregate.Mean
+				fields["watcher_"+k.Name+"_stddev"] = k.Aggregate.StdDev
+				fields["watcher_"+k.Name+"_max"] = k.Aggregate.Max
+				if !k.Aggregate.LastPeakAt.IsZero() {
+					fields["watcher_"+k.Name+"_last_peak_at"] = k.Aggregate.LastPeakAt
+				}
+			}
+		}
+		if l.TCPHealth != nil {
+			var retransmits, lost float64
+			for i := range l.TCPHealth.RTTs {
+				retransmits += l.TCPHealth.Retransmits[i]
+				lost += l.TCPHealth.Lost[i]
+			}
+			fields["max_rtt"] = l.TCPHealth.maxRTT().Seconds()
+			fields["retransmits"] = retransmits
+			fields["lost"] = lost
+		}
+		if l.Connections != nil {
+			fields["oldest_connection"] = l.Connections.Oldest.Seconds()
+		}
+		if l.KeepAlive != nil {
+			fields["busy"] = l.KeepAlive.Busy
+			fields["idle"] = l.KeepAlive.Idle
+		}
+		if l.Excluded != nil {
+			fields["excluded"] = *l.Excluded
+		}
+		if l.QueueLimit != 0 {
+			fields["queue_limit"] = l.QueueLimit
+			fields["queue_ratio"] = l.queueRatio()
+		}
+		if l.States != nil {
+			states := make(map[string]float64)
+			for code, count := range l.States {
+				if tcpStateNames[code] != "" {
+					states[tcpStateNames[code]] = count
+				}
+			}
+			fields["states"] = states
+		}
+		log.WithFields(fields).Info(raindropsURL)
+	}
+
+	for _, w := range r.PumaWorkers {
+		log.WithFields(log.Fields{
+			"worker_index": w.Index,
+			"active":       w.Active,
+			"queued":       w.Queued,
+			"capacity":     w.Capacity,
+		}).Info(raindropsURL)
+	}
 }
 
 func main() {
@@ -221,6 +711,18 @@ func main() {
 	}
 	log.Info("RG_USE_SOCKET_STATS: ", useSocketStats)
 
+	// socket stats can be collected by reading /proc/net/tcp{,6} or by querying
+	// the kernel over netlink (inet_diag), which only returns sockets on RG_SERVER_PORT
+	socketStatsCollector := os.Getenv("RG_SOCKET_STATS_COLLECTOR")
+	if socketStatsCollector == "" {
+		socketStatsCollector = "procfs"
+	} else if socketStatsCollector != "procfs" && socketStatsCollector != "netlink" {
+		log.Fatal("RG_SOCKET_STATS_COLLECTOR must be either procfs or netlink")
+	}
+	if useSocketStats == "true" {
+		log.Info("RG_SOCKET_STATS_COLLECTOR: ", socketStatsCollector)
+	}
+
 	statsdEnabled := os.Getenv("RG_STATSD_ENABLED")
 	if statsdEnabled == "" {
 		log.Warning("RG_STATSD_ENABLED is not defined. Set to true by default")
@@ -242,14 +744,91 @@ func main() {
 	}
 
 	raindropsURL := os.Getenv("RG_RAINDROPS_URL")
+	// Raindrops::Watcher app, which can be used instead of or along with the middleware
+	watcherURL := os.Getenv("RG_RAINDROPS_WATCHER_URL")
+	// Puma control app, as passed to --control-url
+	pumaControlURL := os.Getenv("RG_PUMA_CONTROL_URL")
+	// Phusion Passenger, through passenger-status
+	passengerEnabled := os.Getenv("RG_PASSENGER_ENABLED")
+	if passengerEnabled == "" {
+		passengerEnabled = "false"
+	}
 	if raindropsURL == "" {
-		if useThreads == "false" && useSocketStats == "false" {
+		if useThreads == "false" && useSocketStats == "false" && watcherURL == "" && pumaControlURL == "" && passengerEnabled == "false" {
 			log.Fatal("RG_RAINDROPS_URL is missing")
 		}
 	} else {
 		log.Info("RG_RAINDROPS_URL: ", raindropsURL)
 	}
 
+	if pumaControlURL != "" {
+		log.Info("RG_PUMA_CONTROL_URL: ", pumaControlURL)
+		// with the socket stats, Puma only reports the number of threads
+		if useThreads != "true" {
+			log.Warning("RG_PUMA_CONTROL_URL is set. RG_THREADS set to true")
+			useThreads = "true"
+		}
+	}
+
+	passengerStatusCommand := os.Getenv("RG_PASSENGER_STATUS_COMMAND")
+	if passengerStatusCommand == "" {
+		passengerStatusCommand = "passenger-status"
+	}
+	log.Info("RG_PASSENGER_ENABLED: ", passengerEnabled)
+	if passengerEnabled == "true" {
+		log.Info("RG_PASSENGER_STATUS_COMMAND: ", passengerStatusCommand)
+		if useSocketStats == "true" {
+			log.Fatal("RG_PASSENGER_ENABLED requires RG_USE_SOCKET_STATS=false")
+		}
+		if pumaControlURL != "" {
+			log.Fatal("RG_PASSENGER_ENABLED and RG_PUMA_CONTROL_URL are mutually exclusive")
+		}
+	}
+
+	// addresses of the listeners the Watcher reports on, as a comma separated list
+	watcherListeners := os.Getenv("RG_RAINDROPS_WATCHER_LISTENERS")
+	if watcherURL != "" {
+		log.Info("RG_RAINDROPS_WATCHER_URL: ", watcherURL)
+		if watcherListeners == "" {
+			log.Fatal("RG_RAINDROPS_WATCHER_LISTENERS is missing")
+		}
+		log.Info("RG_RAINDROPS_WATCHER_LISTENERS: ", watcherListeners)
+	}
+
+	raindropsTimeout := os.Getenv("RG_RAINDROPS_TIMEOUT")
+	if raindropsTimeout == "" {
+		raindropsTimeout = "3s"
+	}
+	fetchTimeout, err := time.ParseDuration(raindropsTimeout)
+	checkFatal(err)
+	// `Name: value` headers, one per line
+	raindropsHeaders := os.Getenv("RG_RAINDROPS_HEADERS")
+	fetchHeader, err := parseHeaders(raindropsHeaders)
+	checkFatal(err)
+	raindropsOpts := raindropsOptions{
+		Timeout:  fetchTimeout,
+		Header:   fetchHeader,
+		Username: os.Getenv("RG_RAINDROPS_USERNAME"),
+		Password: os.Getenv("RG_RAINDROPS_PASSWORD"),
+		Token:    os.Getenv("RG_RAINDROPS_TOKEN"),
+		CAFile:   os.Getenv("RG_RAINDROPS_CA_FILE"),
+	}
+	if raindropsURL != "" || watcherURL != "" {
+		log.Info("RG_RAINDROPS_TIMEOUT: ", raindropsTimeout)
+		if raindropsHeaders != "" {
+			// values are not logged as they may hold credentials
+			names := make([]string, 0, len(raindropsOpts.Header))
+			for name := range raindropsOpts.Header {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			log.Info("RG_RAINDROPS_HEADERS: ", strings.Join(names, ","))
+		}
+		if raindropsOpts.CAFile != "" {
+			log.Info("RG_RAINDROPS_CA_FILE: ", raindropsOpts.CAFile)
+		}
+	}
+
 	statsdHost := os.Getenv("RG_STATSD_HOST")
 	if statsdHost == "" {
 		log.Warning("RG_STATSD_HOST is missing")
@@ -271,14 +850,290 @@ func main() {
 
 	statsdExtraTags := os.Getenv("RG_STATSD_EXTRA_TAGS")
 
+	// unix domain sockets the web server listens to, as a comma separated list of paths
+	serverSocket := os.Getenv("RG_SERVER_SOCKET")
+	if serverSocket != "" {
+		log.Info("RG_SERVER_SOCKET: ", serverSocket)
+	}
+
+	// TCP ports the web server listens to, as a comma separated list
 	serverPort := os.Getenv("RG_SERVER_PORT")
 	if serverPort == "" {
-		serverPort = "3000"
-		log.Warning("RG_SERVER_PORT is not defined. Set to 3000 by default")
+		if serverSocket == "" {
+			serverPort = "3000"
+			log.Warning("RG_SERVER_PORT is not defined. Set to 3000 by default")
+		}
 	} else {
 		log.Info("RG_SERVER_PORT: ", serverPort)
 	}
 
+	listeners, err := parseListeners(serverPort, serverSocket)
+	if err != nil && useSocketStats == "true" {
+		log.Fatal(err)
+	}
+
+	// report the sum of all listeners as the `total` listener
+	listenersTotal := os.Getenv("RG_LISTENERS_TOTAL")
+	if listenersTotal == "" {
+		listenersTotal = "false"
+	}
+	log.Info("RG_LISTENERS_TOTAL: ", listenersTotal)
+
+	tcpStatesEnabled := os.Getenv("RG_TCP_STATES_ENABLED")
+	if tcpStatesEnabled == "" {
+		tcpStatesEnabled = "false"
+	}
+	log.Info("RG_TCP_STATES_ENABLED: ", tcpStatesEnabled)
+
+	queueLimitEnabled := os.Getenv("RG_QUEUE_LIMIT_ENABLED")
+	if queueLimitEnabled == "" {
+		queueLimitEnabled = "false"
+	}
+	log.Info("RG_QUEUE_LIMIT_ENABLED: ", queueLimitEnabled)
+
+	// backlog the web server passes to listen(2), only needed when netlink is not used
+	var listenBacklog float64
+	if backlog := os.Getenv("RG_LISTEN_BACKLOG"); backlog != "" {
+		listenBacklog, err = strconv.ParseFloat(backlog, 64)
+		checkFatal(err)
+		log.Info("RG_LISTEN_BACKLOG: ", backlog)
+	}
+
+	// connections from these networks (eg: health checks) are not counted as active
+	excludedCIDRs := os.Getenv("RG_EXCLUDE_REMOTE_CIDRS")
+	excludedNets, err := parseExcludedNets(excludedCIDRs)
+	checkFatal(err)
+	if excludedCIDRs != "" {
+		log.Info("RG_EXCLUDE_REMOTE_CIDRS: ", excludedCIDRs)
+	}
+
+	excludedEnabled := os.Getenv("RG_EXCLUDED_CONNECTIONS_ENABLED")
+	if excludedEnabled == "" {
+		excludedEnabled = "false"
+	}
+	log.Info("RG_EXCLUDED_CONNECTIONS_ENABLED: ", excludedEnabled)
+
+	// tell idle keep-alive connections from busy ones, requires the netlink collector
+	keepAliveEnabled := os.Getenv("RG_KEEPALIVE_STATS_ENABLED")
+	if keepAliveEnabled == "" {
+		keepAliveEnabled = "false"
+	}
+	log.Info("RG_KEEPALIVE_STATS_ENABLED: ", keepAliveEnabled)
+
+	activeBusyOnly := os.Getenv("RG_ACTIVE_BUSY_ONLY")
+	if activeBusyOnly == "" {
+		activeBusyOnly = "false"
+	}
+	log.Info("RG_ACTIVE_BUSY_ONLY: ", activeBusyOnly)
+
+	if (keepAliveEnabled == "true" || activeBusyOnly == "true") && socketStatsCollector != "netlink" {
+		log.Warning("idle keep-alive connections can only be detected by the netlink collector")
+	}
+
+	// report the RTT and retransmits of the connections, requires the netlink collector
+	tcpHealthEnabled := os.Getenv("RG_TCP_HEALTH_ENABLED")
+	if tcpHealthEnabled == "" {
+		tcpHealthEnabled = "false"
+	}
+	log.Info("RG_TCP_HEALTH_ENABLED: ", tcpHealthEnabled)
+	if tcpHealthEnabled == "true" && socketStatsCollector != "netlink" {
+		log.Warning("the health of the connections can only be reported by the netlink collector")
+	}
+
+	// follow the connections across polls to report their age
+	connectionAgeEnabled := os.Getenv("RG_CONNECTION_AGE_ENABLED")
+	if connectionAgeEnabled == "" {
+		connectionAgeEnabled = "false"
+	}
+	log.Info("RG_CONNECTION_AGE_ENABLED: ", connectionAgeEnabled)
+
+	// estimate the request rate out of the newly accepted connections
+	throughputEnabled := os.Getenv("RG_THROUGHPUT_ENABLED")
+	if throughputEnabled == "" {
+		throughputEnabled = "false"
+	}
+	log.Info("RG_THROUGHPUT_ENABLED: ", throughputEnabled)
+
+	throughputWindow := os.Getenv("RG_THROUGHPUT_WINDOW")
+	if throughputWindow == "" {
+		throughputWindow = "10s"
+	}
+	window, err := time.ParseDuration(throughputWindow)
+	checkFatal(err)
+	if throughputEnabled == "true" {
+		log.Info("RG_THROUGHPUT_WINDOW: ", throughputWindow)
+	}
+
+	socketOpts := socketStatsOptions{
+		Total:          listenersTotal == "true",
+		TCPStates:      tcpStatesEnabled == "true",
+		QueueLimit:     queueLimitEnabled == "true",
+		ListenBacklog:  listenBacklog,
+		ExcludedNets:   excludedNets,
+		Excluded:       excludedEnabled == "true",
+		KeepAlive:      keepAliveEnabled == "true",
+		ActiveBusyOnly: activeBusyOnly == "true",
+		ConnectionAge:  connectionAgeEnabled == "true",
+		Throughput:     throughputEnabled == "true",
+		TCPHealth:      tcpHealthEnabled == "true",
+	}
+
+	// report the connections refused by the kernel, from /proc/net/netstat
+	listenDropsEnabled := os.Getenv("RG_LISTEN_DROPS_ENABLED")
+	if listenDropsEnabled == "" {
+		listenDropsEnabled = "false"
+	}
+	log.Info("RG_LISTEN_DROPS_ENABLED: ", listenDropsEnabled)
+
+	// attribute the active connections to the worker processes of the app,
+	// raingutter needs to share the PID namespace of the app
+	workersEnabled := os.Getenv("RG_WORKER_ATTRIBUTION_ENABLED")
+	if workersEnabled == "" {
+		workersEnabled = "false"
+	}
+	log.Info("RG_WORKER_ATTRIBUTION_ENABLED: ", workersEnabled)
+
+	workerProcess := os.Getenv("RG_WORKER_PROCESS")
+	if workerProcess == "" {
+		workerProcess = "worker"
+	}
+	workerPattern, err := regexp.Compile(workerProcess)
+	checkFatal(err)
+
+	workerBusyThreshold := os.Getenv("RG_WORKER_BUSY_THRESHOLD")
+	if workerBusyThreshold == "" {
+		workerBusyThreshold = "30s"
+	}
+	busyThreshold, err := time.ParseDuration(workerBusyThreshold)
+	checkFatal(err)
+	if workersEnabled == "true" {
+		log.Info("RG_WORKER_PROCESS: ", workerProcess)
+		log.Info("RG_WORKER_BUSY_THRESHOLD: ", workerBusyThreshold)
+	}
+
+	// where procfs is mounted, eg: the /proc of the host mounted at /host/proc
+	procRoot := os.Getenv("RG_PROC_ROOT")
+	if procRoot == "" {
+		procRoot = "/proc"
+	}
+	log.Info("RG_PROC_ROOT: ", procRoot)
+
+	// monitor the network namespace of another process, by pid or command line
+	target := targetProcess{ProcRoot: procRoot}
+	targetPid := os.Getenv("RG_TARGET_PID")
+	targetProcessPattern := os.Getenv("RG_TARGET_PROCESS")
+	if targetPid != "" && targetProcessPattern != "" {
+		log.Fatal("RG_TARGET_PID and RG_TARGET_PROCESS are mutually exclusive")
+	}
+	if targetPid != "" {
+		log.Info("RG_TARGET_PID: ", targetPid)
+		target.Pid, err = strconv.Atoi(targetPid)
+		checkFatal(err)
+	}
+	if targetProcessPattern != "" {
+		log.Info("RG_TARGET_PROCESS: ", targetProcessPattern)
+		target.Pattern, err = regexp.Compile(targetProcessPattern)
+		checkFatal(err)
+	}
+
+	// the number of threads is discovered from the app, unless MAX_THREADS is set
+	threads := threadCapacity{ProcRoot: procRoot, App: appProcess{Pid: target.Pid}}
+	if maxThreads := os.Getenv("MAX_THREADS"); maxThreads != "" {
+		log.Info("MAX_THREADS: ", maxThreads)
+		threads.Override, err = strconv.ParseFloat(maxThreads, 64)
+		checkFatal(err)
+	}
+	// the processes of the app, whose environment holds its settings. Raingutter
+	// needs to share its PID namespace
+	appPattern := os.Getenv("RG_APP_PROCESS")
+	if appPattern == "" {
+		appPattern = targetProcessPattern
+	}
+	if appPattern == "" {
+		if useThreads == "true" {
+			appPattern = "^puma"
+		} else {
+			appPattern = "^unicorn master"
+		}
+	}
+	threads.App.Pattern, err = regexp.Compile(appPattern)
+	checkFatal(err)
+
+	// the number of workers is discovered from the unicorn master, and compared with
+	// UNICORN_WORKERS if set
+	workers := workerCapacity{
+		ProcRoot:      procRoot,
+		App:           threads.App,
+		PidFile:       os.Getenv("RG_UNICORN_PIDFILE"),
+		WorkerPattern: workerPattern,
+		Target:        target,
+	}
+	if len(listeners) > 0 && listeners[0].Path == "" {
+		workers.Port = listeners[0].Port
+	}
+	if unicornWorkers := os.Getenv("UNICORN_WORKERS"); unicornWorkers != "" {
+		log.Info("UNICORN_WORKERS: ", unicornWorkers)
+		workers.Configured, err = strconv.ParseFloat(unicornWorkers, 64)
+		checkFatal(err)
+	}
+	unicornMaster := os.Getenv("RG_UNICORN_MASTER_PROCESS")
+	if unicornMaster == "" {
+		unicornMaster = "^unicorn master"
+	}
+	workers.MasterPattern, err = regexp.Compile(unicornMaster)
+	checkFatal(err)
+
+	capacityRefresh := os.Getenv("RG_CAPACITY_REFRESH")
+	if capacityRefresh == "" {
+		capacityRefresh = "60s"
+	}
+	capacityInterval, err := time.ParseDuration(capacityRefresh)
+	checkFatal(err)
+	log.Info("RG_APP_PROCESS: ", appPattern)
+	if useThreads != "true" {
+		if workers.PidFile != "" {
+			log.Info("RG_UNICORN_PIDFILE: ", workers.PidFile)
+		}
+		log.Info("RG_UNICORN_MASTER_PROCESS: ", unicornMaster)
+	}
+	log.Info("RG_CAPACITY_REFRESH: ", capacityRefresh)
+
+	// monitor every pod of the node which opts in, instead of a single app
+	nodeMode := os.Getenv("RG_NODE_MODE")
+	if nodeMode == "" {
+		nodeMode = "false"
+	}
+	log.Info("RG_NODE_MODE: ", nodeMode)
+	if nodeMode == "true" && useSocketStats != "true" {
+		log.Fatal("RG_NODE_MODE requires RG_USE_SOCKET_STATS")
+	}
+
+	kubeletURL := os.Getenv("RG_KUBELET_URL")
+	if kubeletURL == "" {
+		kubeletURL = "https://127.0.0.1:10250/pods"
+	}
+	kubeletTokenFile := os.Getenv("RG_KUBELET_TOKEN_FILE")
+	if kubeletTokenFile == "" {
+		kubeletTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	// the kubelet serving certificate is usually self-signed
+	kubeletInsecure := os.Getenv("RG_KUBELET_INSECURE_SKIP_VERIFY")
+	if kubeletInsecure == "" {
+		kubeletInsecure = "false"
+	}
+	kubeletRefresh := os.Getenv("RG_KUBELET_REFRESH")
+	if kubeletRefresh == "" {
+		kubeletRefresh = "30s"
+	}
+	refreshInterval, err := time.ParseDuration(kubeletRefresh)
+	checkFatal(err)
+	if nodeMode == "true" {
+		log.Info("RG_KUBELET_URL: ", kubeletURL)
+		log.Info("RG_KUBELET_TOKEN_FILE: ", kubeletTokenFile)
+		log.Info("RG_KUBELET_INSECURE_SKIP_VERIFY: ", kubeletInsecure)
+		log.Info("RG_KUBELET_REFRESH: ", kubeletRefresh)
+	}
+
 	// raingutter polling frequency expressed in ms
 	frequency := os.Getenv("RG_FREQUENCY")
 	if frequency == "" {
@@ -287,46 +1142,41 @@ func main() {
 	log.Info("RG_FREQUENCY: ", frequency)
 	freqInt, _ := strconv.Atoi(frequency)
 
-	if podName == "" {
-		log.Warn("POD_NAME is missing")
-	}
+	// in node mode, the metrics are tagged with the monitored pods
+	if nodeMode != "true" {
+		if podName == "" {
+			log.Warn("POD_NAME is missing")
+		}
 
-	if podNameSpace == "" {
-		log.Warn("POD_NAMESPACE is missing")
-	}
+		if podNameSpace == "" {
+			log.Warn("POD_NAMESPACE is missing")
+		}
 
-	if project == "" {
-		log.Warn("PROJECT is missing")
+		if project == "" {
+			log.Warn("PROJECT is missing")
+		}
 	}
 
 	r := raingutter{}
 
-	// Add k8s tags
-	if podName != "" {
-		tag := "pod_name:" + podName
-		statsdTags = append(statsdTags, tag)
-	}
-
-	if podNameSpace != "" {
-		tag := "pod_namespace:" + podNameSpace
-		statsdTags = append(statsdTags, tag)
-	}
+	statsdTags = newStatsdTags(nodeMode == "true", statsdExtraTags)
 
-	if project != "" {
-		tag := "project:" + project
-		statsdTags = append(statsdTags, tag)
-	}
+	// Create the raindrops http client
+	httpClient, raindropsFetchURL, err := newRaindropsClient(raindropsURL, defaultRaindropsPath, raindropsOpts)
+	checkFatal(err)
 
-	// Add extra tags
-	if statsdExtraTags != "" {
-		tags := strings.Split(statsdExtraTags, ",")
-		statsdTags = append(statsdTags, tags...)
+	var puma *pumaControl
+	if pumaControlURL != "" {
+		puma, err = newPumaControl(pumaControlURL, os.Getenv("RG_PUMA_CONTROL_TOKEN"), raindropsOptions{Timeout: pumaTimeout})
+		checkFatal(err)
+		threads.Puma = puma
 	}
 
-	// Create an http client
-	timeout := time.Duration(3 * time.Second)
-	httpClient := http.Client{
-		Timeout: timeout,
+	var watcher *raindropsWatcher
+	if watcherURL != "" {
+		watcher = &raindropsWatcher{Listeners: strings.Split(watcherListeners, ",")}
+		watcher.Client, watcher.URL, err = newRaindropsClient(watcherURL, "", raindropsOpts)
+		checkFatal(err)
 	}
 
 	// Create a statsd udp client
@@ -345,59 +1195,163 @@ func main() {
 		os.Exit(0)
 	}()
 
-	tc := totalConnections{Count: 0}
-	if useThreads == "true" {
-		getThreads(&tc)
+	emit := func(r *raingutter, c statsd.ClientInterface, tc *totalConnections) {
+		if statsdEnabled == "true" {
+			r.sendStats(c, tc, useThreads)
+		}
+		if prometheusEnabled == "true" {
+			r.recordMetrics(tc, useThreads)
+		}
+		if logMetricsEnabled == "true" {
+			r.logMetrics(tc, raindropsURL)
+		}
+	}
 
-	} else {
+	if nodeMode == "true" {
+		kubelet := kubeletClient{
+			Client: &http.Client{
+				Timeout: 10 * time.Second,
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: kubeletInsecure == "true"},
+				},
+			},
+			URL: kubeletURL,
+		}
+		// the token is only needed when the kubelet requires authentication
+		if _, err := os.Stat(kubeletTokenFile); err == nil {
+			kubelet.TokenFile = kubeletTokenFile
+		}
+		node := nodeMonitor{
+			ProcRoot: procRoot,
+			Pods:     map[string]*podMonitor{},
+			NewMonitor: func(listeners []listener) *socketMonitor {
+				m := newSocketMonitor(socketStatsCollector, targetProcess{}, listeners, socketOpts, window)
+				if workersEnabled == "true" {
+					m.Workers = newWorkerTracker(busyThreshold)
+					m.WorkerPattern = workerPattern
+				}
+				return m
+			},
+			NewStatsd: func(pod podInfo) statsd.ClientInterface {
+				return podStatsdClient(statsdClient, pod)
+			},
+		}
+
+		var lastRefresh time.Time
+		for {
+			time.Sleep(time.Millisecond * time.Duration(freqInt))
+			if time.Since(lastRefresh) >= refreshInterval {
+				lastRefresh = time.Now()
+				gone, err := node.refresh(&kubelet)
+				if err != nil {
+					log.Error(err)
+				}
+				if prometheusEnabled == "true" {
+					for _, pod := range gone {
+						deletePodMetrics(pod)
+					}
+				}
+			}
+
+			for _, p := range node.Pods {
+				if err := p.Monitor.poll(&p.Stats); err != nil {
+					log.WithFields(log.Fields{
+						"pod_name":      p.Pod.Name,
+						"pod_namespace": p.Pod.Namespace,
+					}).Error(err)
+					continue
+				}
+				if listenDropsEnabled == "true" {
+					p.Stats.ListenDrops = p.Monitor.collectListenDrops()
+				}
+				emit(&p.Stats, p.Statsd, &p.Capacity)
+			}
+		}
+	}
+
+	tc := totalConnections{Count: 0}
+	switch {
+	case puma != nil && useSocketStats != "true":
+		// the number of threads is reported by Puma on every poll, unless overridden
+		tc.Count = threads.Override
+	case passengerEnabled == "true":
+		// the size of the pool is reported by Passenger on every poll
+	case useThreads == "true":
 		go func() {
 			for {
-				getWorkers(&tc)
-				// sleep for a minute
-				<-time.After(60 * time.Second)
+				getThreads(&tc, &threads)
+				<-time.After(capacityInterval)
+			}
+		}()
+	default:
+		go func() {
+			for {
+				getWorkers(&tc, &workers)
+				<-time.After(capacityInterval)
 			}
 		}()
 	}
 
 	readiness := status{Ready: false}
+	monitor := newSocketMonitor(socketStatsCollector, target, listeners, socketOpts, window)
+	if workersEnabled == "true" {
+		monitor.Workers = newWorkerTracker(busyThreshold)
+		monitor.WorkerPattern = workerPattern
+	}
 	for {
 		didScan := false
 
 		time.Sleep(time.Millisecond * time.Duration(freqInt))
 		// using SocketStats is the recommended method
 		if useSocketStats == "true" {
-			rawStats, err := GetSocketStats()
+			if err := monitor.poll(&r); err != nil {
+				log.Error(err)
+			} else {
+				didScan = true
+			}
+		} else if passengerEnabled == "true" {
+			status, err := GetPassengerStatus(passengerStatusCommand, passengerTimeout)
 			if err != nil {
 				log.Error(err)
+			} else {
+				tc.Count = r.ScanPassengerStatus(status)
+				didScan = true
 			}
-
-			stats, err := ParseSocketStats(serverPort, rawStats)
+		} else if puma != nil {
+			stats, err := puma.Stats()
 			if err != nil {
 				log.Error(err)
 			} else {
-				r.ScanSocketStats(stats)
+				if capacity := r.ScanPumaStats(stats); threads.Override == 0 {
+					tc.Count = capacity
+				}
 				didScan = true
 			}
 		} else {
 			// if SocketStats is disabled, raingutter will use the raindrops endpoint
 			// to retrieve metrics from the unicorn master
-			body := Fetch(httpClient, raindropsURL, &readiness)
-			if body != nil {
-				r.Scan(body)
-				didScan = true
+			if raindropsURL != "" {
+				body := Fetch(httpClient, raindropsFetchURL, &readiness)
+				if body != nil {
+					r.Scan(body, listenersTotal == "true")
+					didScan = true
+				}
+			}
+			// the Watcher adds the peaks between two polls, or replaces the middleware
+			if watcher != nil && (didScan || raindropsURL == "") {
+				if err := watcher.Scan(&r, raindropsURL == "", listenersTotal == "true"); err != nil {
+					log.Error(err)
+				} else {
+					didScan = true
+				}
 			}
 		}
 
 		if didScan {
-			if statsdEnabled == "true" {
-				r.sendStats(statsdClient, &tc, useThreads)
-			}
-			if prometheusEnabled == "true" {
-				r.recordMetrics(&tc, useThreads)
-			}
-			if logMetricsEnabled == "true" {
-				r.logMetrics(&tc, raindropsURL)
+			if listenDropsEnabled == "true" {
+				r.ListenDrops = monitor.collectListenDrops()
 			}
+			emit(&r, statsdClient, &tc)
 		}
 	}
 
@@ -2,9 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -64,7 +68,7 @@ func TestScan(t *testing.T) {
 		s := status{Ready: true}
 		res := Fetch(httpClient, ts.URL, &s)
 		r := raingutter{}
-		r.Scan(res)
+		r.Scan(res, false)
 		switch {
 		case r.Calling != 1:
 			t.Errorf("calling is %v expecting 1", r.Calling)
@@ -78,6 +82,34 @@ func TestScan(t *testing.T) {
 	}
 }
 
+func TestScanListeners(t *testing.T) {
+	out := `calling: 1
+writing: 2
+0.0.0.0:3000 active: 3
+0.0.0.0:3000 queued: 4
+/tmp/active.sock active: 5
+/tmp/active.sock queued: 0`
+	for _, total := range []bool{false, true} {
+		res := &http.Response{Body: io.NopCloser(strings.NewReader(out))}
+		r := raingutter{Listeners: []listenerStats{{Listener: "stale"}}}
+		r.Scan(res, total)
+
+		expected := []listenerStats{
+			{Listener: "0.0.0.0:3000", Active: 3, Queued: 4},
+			{Listener: "/tmp/active.sock", Active: 5, Queued: 0},
+		}
+		if total {
+			expected = append(expected, listenerStats{Listener: "total", Active: 8, Queued: 4})
+		}
+		if !reflect.DeepEqual(r.Listeners, expected) {
+			t.Errorf("Scan(total: %v): expected %+v, actual %+v", total, expected, r.Listeners)
+		}
+		if r.Active != 8 || r.Queued != 4 || r.Calling != 1 || r.Writing != 2 {
+			t.Errorf("Scan(total: %v): expected the sum of the listeners, actual %+v", total, r)
+		}
+	}
+}
+
 func TestParse(t *testing.T) {
 	for _, out := range Lines {
 		actual := Parse(out.n)
@@ -88,10 +120,186 @@ func TestParse(t *testing.T) {
 }
 
 func TestUnicornWorkerEnv(t *testing.T) {
-	os.Setenv("UNICORN_WORKERS", "16")
+	// UNICORN_WORKERS is used when the master can't be found
+	capacity := workerCapacity{Configured: 16, ProcRoot: t.TempDir()}
 	tc := totalConnections{Count: 0}
-	getWorkers(&tc)
+	getWorkers(&tc, &capacity)
 	if tc.Count != 16 {
 		t.Errorf("Unicorn workers is: %v. It should be 16", tc.Count)
 	}
 }
+
+func TestScanListenersSocketStats(t *testing.T) {
+	listeners := []listener{{Port: 3000}, {Path: "/tmp/unicorn.sock"}}
+	stats := []*SocketStats{{QueueSize: 1, ActiveWorkers: 2}, {QueueSize: 3, ActiveWorkers: 4}}
+
+	r := raingutter{}
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{Total: true})
+	if r.Active != 6 || r.Queued != 4 {
+		t.Errorf("active/queued are %v/%v expecting 6/4", r.Active, r.Queued)
+	}
+	expected := []listenerStats{
+		{Listener: "3000", Active: 2, Queued: 1},
+		{Listener: "/tmp/unicorn.sock", Active: 4, Queued: 3},
+		{Listener: "total", Active: 6, Queued: 4},
+	}
+	if !reflect.DeepEqual(r.Listeners, expected) {
+		t.Errorf("listeners: expected %v, actual %v", expected, r.Listeners)
+	}
+
+	r.ScanListenersSocketStats(listeners[:1], stats[:1], socketStatsOptions{})
+	if len(r.Listeners) != 1 || r.Active != 2 {
+		t.Errorf("listeners are not reset between scans: %v", r.Listeners)
+	}
+}
+
+func TestScanListenersSocketStatsStates(t *testing.T) {
+	listeners := []listener{{Port: 3000}, {Port: 9292}, {Path: "/tmp/unicorn.sock"}}
+	stats := []*SocketStats{
+		{States: TCPStates{1: 2, 8: 1, 10: 1}},
+		{States: TCPStates{3: 4, 10: 1}},
+		{QueueSize: 1},
+	}
+
+	r := raingutter{}
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{Total: true, TCPStates: true})
+	expected := []*TCPStates{
+		{1: 2, 8: 1, 10: 1},
+		{3: 4, 10: 1},
+		nil,
+		{1: 2, 3: 4, 8: 1, 10: 2},
+	}
+	for i, l := range r.Listeners {
+		if !reflect.DeepEqual(l.States, expected[i]) {
+			t.Errorf("listener %v states: expected %v, actual %v", l.Listener, expected[i], l.States)
+		}
+	}
+}
+
+func TestScanListenersSocketStatsQueueLimit(t *testing.T) {
+	listeners := []listener{{Port: 3000}, {Port: 9292}}
+	stats := []*SocketStats{{QueueSize: 64, QueueLimit: 128}, {QueueSize: 0, QueueLimit: 1024}}
+
+	r := raingutter{}
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{Total: true, QueueLimit: true})
+	expected := []float64{0.5, 0, 64.0 / 1152}
+	for i, l := range r.Listeners {
+		if l.queueRatio() != expected[i] {
+			t.Errorf("listener %v queue ratio: expected %v, actual %v", l.Listener, expected[i], l.queueRatio())
+		}
+	}
+
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{})
+	if r.Listeners[0].QueueLimit != 0 {
+		t.Errorf("queue limit is reported while disabled: %v", r.Listeners[0].QueueLimit)
+	}
+}
+
+func TestScanListenersSocketStatsKeepAlive(t *testing.T) {
+	listeners := []listener{{Port: 3000}, {Path: "/tmp/unicorn.sock"}}
+	stats := []*SocketStats{
+		{ActiveWorkers: 5, IdleWorkers: 3, HasTCPInfo: true},
+		{ActiveWorkers: 2},
+	}
+
+	r := raingutter{}
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{Total: true, KeepAlive: true, ActiveBusyOnly: true})
+	if r.Active != 4 {
+		t.Errorf("active is %v expecting 4", r.Active)
+	}
+	expected := []*keepAliveStats{{Busy: 2, Idle: 3}, nil, {Busy: 2, Idle: 3}}
+	for i, l := range r.Listeners {
+		if !reflect.DeepEqual(l.KeepAlive, expected[i]) {
+			t.Errorf("listener %v: expected %v, actual %v", l.Listener, expected[i], l.KeepAlive)
+		}
+	}
+
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{})
+	if r.Active != 7 || r.Listeners[0].KeepAlive != nil {
+		t.Errorf("idle connections are left out while disabled: %v", r.Listeners)
+	}
+}
+
+func TestScanListenersSocketStatsTCPHealth(t *testing.T) {
+	listeners := []listener{{Port: 3000}, {Port: 9292}, {Path: "/tmp/unicorn.sock"}}
+	stats := []*SocketStats{
+		{ActiveWorkers: 2, HasTCPInfo: true, ActiveInfos: []TCPInfo{{RTT: 200, TotalRetrans: 3}, {RTT: 50000, Lost: 1}}},
+		{HasTCPInfo: true},
+		{ActiveWorkers: 2},
+	}
+
+	r := raingutter{}
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{Total: true, TCPHealth: true})
+	health := &tcpHealthStats{
+		RTTs:        []time.Duration{200 * time.Microsecond, 50 * time.Millisecond},
+		Retransmits: []float64{3, 0},
+		Lost:        []float64{0, 1},
+	}
+	// listeners without connections have empty distributions, unix sockets have none
+	expected := []*tcpHealthStats{health, {}, nil, health}
+	for i, l := range r.Listeners {
+		if !reflect.DeepEqual(l.TCPHealth, expected[i]) {
+			t.Errorf("listener %v: expected %+v, actual %+v", l.Listener, expected[i], l.TCPHealth)
+		}
+	}
+	if max := r.Listeners[0].TCPHealth.maxRTT(); max != 50*time.Millisecond {
+		t.Errorf("max RTT is %v expecting 50ms", max)
+	}
+
+	r.ScanListenersSocketStats(listeners, stats, socketStatsOptions{})
+	if r.Listeners[0].TCPHealth != nil {
+		t.Errorf("TCP health is reported while disabled: %v", r.Listeners)
+	}
+}
+
+// writeProcFile creates a file of a fake procfs
+func writeProcFile(t *testing.T, procRoot string, name string, content string) {
+	path := filepath.Join(procRoot, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectSocketStatsProcRoot(t *testing.T) {
+	procRoot := t.TempDir()
+	// a listener on port 3000 with 2 queued connections and an accepted one,
+	// and a unix socket with a queued connection
+	writeProcFile(t, procRoot, "42/net/tcp", `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0BB8 00000000:0000 0A 00000000:00000002 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0BB8 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 20 4 30 10 -1
+`)
+	writeProcFile(t, procRoot, "42/net/tcp6", `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+`)
+	writeProcFile(t, procRoot, "42/net/unix", `Num       RefCount Protocol Flags    Type St Inode Path
+0000000000000000: 00000002 00000000 00010000 0001 01 2001 /tmp/unicorn.sock
+0000000000000000: 00000002 00000000 00000000 0001 02 2002 /tmp/unicorn.sock
+`)
+	writeProcFile(t, procRoot, "sys/net/core/somaxconn", "128\n")
+
+	collector := "procfs"
+	target := targetProcess{Pid: 42, ProcRoot: procRoot}
+	listeners := []listener{{Port: 3000}, {Path: "/tmp/unicorn.sock"}}
+	stats, err := collectSocketStats(&collector, &target, &socketTableReader{}, listeners, socketStatsOptions{QueueLimit: true, ListenBacklog: 1024})
+	if err != nil {
+		t.Fatalf("collectSocketStats threw error (%v)", err)
+	}
+
+	expected := []*SocketStats{
+		{QueueSize: 2, ActiveWorkers: 1, States: TCPStates{1: 1, 10: 1}, QueueLimit: 128, ActiveInodes: []string{"1002"}},
+		{QueueSize: 1, QueueLimit: 128},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected %+v, actual %+v", expected, stats)
+	}
+
+	// the unix sockets can't be read
+	if err := os.Remove(filepath.Join(procRoot, "42/net/unix")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collectSocketStats(&collector, &target, &socketTableReader{}, listeners, socketStatsOptions{}); err == nil {
+		t.Errorf("collectSocketStats did not raise error without /proc/net/unix")
+	}
+}
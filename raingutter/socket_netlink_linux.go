@@ -0,0 +1,270 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Port of the Raindrops inet_diag implementation: instead of reading every socket
+// on the host from /proc/net/tcp{,6}, we ask the kernel for the sockets bound to a
+// single local port only
+// https://github.com/tmm1/raindrops/blob/1c18fd9c13f95fef6bcbdc0587d38886fa8e9064/ext/raindrops/linux_inet_diag.c
+const (
+	sockDiagByFamily    = 20 // SOCK_DIAG_BY_FAMILY
+	inetDiagReqBytecode = 1  // INET_DIAG_REQ_BYTECODE
+	inetDiagInfo        = 2  // INET_DIAG_INFO, the struct tcp_info of the socket
+	inetDiagBcSGe       = 2  // INET_DIAG_BC_S_GE
+	inetDiagBcSLe       = 3  // INET_DIAG_BC_S_LE
+
+	// every TCP state: the kernel numbers them from 1 (TCP_ESTABLISHED) to 12 (TCP_NEW_SYN_RECV)
+	tcpAllStates = 0x1ffe
+
+	inetDiagReqV2Len = 56  // sizeof(struct inet_diag_req_v2)
+	inetDiagMsgLen   = 72  // sizeof(struct inet_diag_msg)
+	inetDiagBcOpLen  = 4   // sizeof(struct inet_diag_bc_op)
+	tcpInfoMinLen    = 104 // struct tcp_info up to tcpi_total_retrans
+)
+
+// netlinkDenied reports whether the netlink collector can't be used in this
+// environment, in which case raingutter falls back to /proc/net/tcp
+func netlinkDenied(err error) bool {
+	return errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.EACCES) ||
+		errors.Is(err, syscall.EPROTONOSUPPORT)
+}
+
+// GetNetlinkSocketStats queries NETLINK_INET_DIAG for the ipv4 and ipv6 TCP sockets
+// bound to the port of l and aggregates them the same way ParseListenersSocketStats does.
+// The sockets are looked up in the network namespace at netns, if not empty
+func GetNetlinkSocketStats(l listener, excluded excludedNets, netns string) (*SocketStats, error) {
+	fd, err := inetDiagSocket(netns)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	stats := &SocketStats{HasTCPInfo: true}
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		sockets, err := dumpInetDiag(fd, family, l.Port)
+		if err != nil {
+			return nil, err
+		}
+		// the kernel only filters on the port
+		for _, socket := range sockets {
+			if l.matches(socket) {
+				stats.addSocket(socket, excluded)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// inetDiagSocket opens a NETLINK_INET_DIAG socket in the network namespace at netns,
+// or in the one of raingutter if empty. Sockets stay in the namespace they were
+// created in, so only their creation has to happen in the target namespace. It is
+// done on a thread of its own, which is never unlocked and thus discarded by the
+// runtime instead of running other goroutines in the wrong namespace
+func inetDiagSocket(netns string) (int, error) {
+	if netns == "" {
+		return openInetDiag()
+	}
+
+	type result struct {
+		fd  int
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		runtime.LockOSThread()
+		ns, err := os.Open(netns)
+		if err != nil {
+			done <- result{-1, err}
+			return
+		}
+		defer ns.Close()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			done <- result{-1, fmt.Errorf("could not enter network namespace %s: %w", netns, err)}
+			return
+		}
+		fd, err := openInetDiag()
+		done <- result{fd, err}
+	}()
+	r := <-done
+	return r.fd, r.err
+}
+
+func openInetDiag() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return -1, fmt.Errorf("could not open inet_diag socket: %w", err)
+	}
+	return fd, nil
+}
+
+// inetDiagBytecode builds a filter which only accepts sockets whose source port is
+// port: two comparisons, each followed by the operand op carrying the port itself
+func inetDiagBytecode(port int) []byte {
+	bc := make([]byte, 4*inetDiagBcOpLen)
+	ops := []uint8{inetDiagBcSGe, inetDiagBcSLe}
+	for i, code := range ops {
+		off := i * 2 * inetDiagBcOpLen
+		remaining := len(bc) - off
+		// yes: jump to the next comparison
+		// no: jump past the end of the program, which rejects the socket
+		bc[off] = code
+		bc[off+1] = 2 * inetDiagBcOpLen
+		binary.NativeEndian.PutUint16(bc[off+2:], uint16(remaining+4))
+		binary.NativeEndian.PutUint16(bc[off+inetDiagBcOpLen+2:], uint16(port))
+	}
+	return bc
+}
+
+// inetDiagRequest builds a SOCK_DIAG_BY_FAMILY dump request for family
+func inetDiagRequest(family uint8, port int) []byte {
+	bc := inetDiagBytecode(port)
+	attrLen := syscall.SizeofRtAttr + len(bc)
+	msgLen := syscall.NLMSG_HDRLEN + inetDiagReqV2Len + attrLen
+
+	b := make([]byte, msgLen)
+	// struct nlmsghdr
+	binary.NativeEndian.PutUint32(b[0:], uint32(msgLen))
+	binary.NativeEndian.PutUint16(b[4:], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(b[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(b[8:], 1)
+
+	// struct inet_diag_req_v2, the socket id is left empty
+	req := b[syscall.NLMSG_HDRLEN:]
+	req[0] = family
+	req[1] = syscall.IPPROTO_TCP
+	// idiag_ext: ask for the tcp_info of the sockets too
+	req[2] = 1 << (inetDiagInfo - 1)
+	binary.NativeEndian.PutUint32(req[4:], tcpAllStates)
+
+	// struct rtattr followed by the bytecode
+	attr := req[inetDiagReqV2Len:]
+	binary.NativeEndian.PutUint16(attr[0:], uint16(attrLen))
+	binary.NativeEndian.PutUint16(attr[2:], inetDiagReqBytecode)
+	copy(attr[syscall.SizeofRtAttr:], bc)
+
+	return b
+}
+
+// dumpInetDiag sends a dump request over fd and collects the replies until NLMSG_DONE
+func dumpInetDiag(fd int, family uint8, port int) ([]Socket, error) {
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Sendto(fd, inetDiagRequest(family, port), 0, sa); err != nil {
+		return nil, fmt.Errorf("could not send inet_diag request: %w", err)
+	}
+
+	var sockets []Socket
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("could not read inet_diag response: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return sockets, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("truncated inet_diag error message")
+				}
+				errno := -int32(binary.NativeEndian.Uint32(m.Data[:4]))
+				return nil, fmt.Errorf("inet_diag request failed: %w", syscall.Errno(errno))
+			}
+			socket, err := parseInetDiagMsg(m.Data)
+			if err != nil {
+				return nil, err
+			}
+			sockets = append(sockets, socket)
+		}
+	}
+}
+
+// parseInetDiagMsg converts a struct inet_diag_msg into the same Socket that
+// ParseSocket returns for a line of /proc/net/tcp
+func parseInetDiagMsg(b []byte) (Socket, error) {
+	if len(b) < inetDiagMsgLen {
+		return Socket{}, fmt.Errorf("inet_diag message too short: %d bytes", len(b))
+	}
+	family := b[0]
+	state := b[1]
+	// idiag_sport and the addresses are in network byte order
+	localPort := binary.BigEndian.Uint16(b[4:6])
+	localAddr, _ := netip.AddrFromSlice(b[8:24])
+	remoteAddr, _ := netip.AddrFromSlice(b[24:40])
+	if family == syscall.AF_INET {
+		localAddr, _ = netip.AddrFromSlice(b[8:12])
+		remoteAddr, _ = netip.AddrFromSlice(b[24:28])
+	}
+	rqueue := binary.NativeEndian.Uint32(b[56:60])
+	wqueue := binary.NativeEndian.Uint32(b[60:64])
+	inode := binary.NativeEndian.Uint32(b[68:72])
+
+	socket := Socket{
+		LocalAddr:  localAddr,
+		LocalPort:  int64(localPort),
+		RemoteAddr: remoteAddr,
+		ConnState:  tcpStateName(state),
+		Inode:      strconv.FormatUint(uint64(inode), 10),
+		QueueSize:  float64(rqueue),
+	}
+	// for LISTEN sockets, idiag_wqueue is the backlog (sk_max_ack_backlog)
+	if socket.ConnState == "LISTEN" {
+		socket.QueueLimit = float64(wqueue)
+	}
+
+	// the message is followed by the attributes requested through idiag_ext
+	attrs := b[inetDiagMsgLen:]
+	for len(attrs) >= syscall.SizeofRtAttr {
+		attrLen := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		attrType := binary.NativeEndian.Uint16(attrs[2:4])
+		if attrLen < syscall.SizeofRtAttr || attrLen > len(attrs) {
+			break
+		}
+		if attrType == inetDiagInfo {
+			socket.Info = parseTCPInfo(attrs[syscall.SizeofRtAttr:attrLen])
+		}
+		// attributes are aligned to 4 bytes
+		next := (attrLen + 3) &^ 3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	return socket, nil
+}
+
+// parseTCPInfo decodes the fields of struct tcp_info raingutter uses, it returns nil
+// if the kernel sent a truncated struct
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/include/uapi/linux/tcp.h
+func parseTCPInfo(b []byte) *TCPInfo {
+	if len(b) < tcpInfoMinLen {
+		return nil
+	}
+	return &TCPInfo{
+		Unacked:      binary.NativeEndian.Uint32(b[24:28]),
+		Lost:         binary.NativeEndian.Uint32(b[32:36]),
+		Retrans:      binary.NativeEndian.Uint32(b[36:40]),
+		LastDataSent: binary.NativeEndian.Uint32(b[44:48]),
+		LastDataRecv: binary.NativeEndian.Uint32(b[52:56]),
+		RTT:          binary.NativeEndian.Uint32(b[68:72]),
+		TotalRetrans: binary.NativeEndian.Uint32(b[100:104]),
+	}
+}
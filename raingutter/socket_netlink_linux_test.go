@@ -0,0 +1,254 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInetDiagBytecode(t *testing.T) {
+	bc := inetDiagBytecode(3000)
+	if len(bc) != 16 {
+		t.Fatalf("inetDiagBytecode(3000): expected 16 bytes, actual %v", len(bc))
+	}
+	// op code, yes, no, port operand
+	expected := [][4]int{
+		{inetDiagBcSGe, 8, 20, 3000},
+		{inetDiagBcSLe, 8, 12, 3000},
+	}
+	for i, op := range expected {
+		b := bc[i*8:]
+		actual := [4]int{
+			int(b[0]),
+			int(b[1]),
+			int(binary.NativeEndian.Uint16(b[2:])),
+			int(binary.NativeEndian.Uint16(b[6:])),
+		}
+		if actual != op {
+			t.Errorf("inetDiagBytecode(3000) op %v: expected %v, actual %v", i, op, actual)
+		}
+	}
+}
+
+func TestGetNetlinkSocketStats(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := listener{Port: ln.Addr().(*net.TCPAddr).Port}
+
+	// the client connection sits in the accept queue until it's accepted
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stats, err := GetNetlinkSocketStats(port, nil, "")
+	if netlinkDenied(err) {
+		t.Skip("netlink is not available: ", err)
+	}
+	if err != nil {
+		t.Fatalf("GetNetlinkSocketStats threw error (%v)", err)
+	}
+	// Go listens with a backlog of net.core.somaxconn
+	somaxconn, err := GetSomaxconn("/proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SocketStats{QueueSize: 1, States: TCPStates{1: 1, 10: 1}, QueueLimit: somaxconn, HasTCPInfo: true}
+	if !reflect.DeepEqual(*stats, expected) {
+		t.Errorf("before accept: expected %v, actual %v", expected, *stats)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stats, err = GetNetlinkSocketStats(port, nil, "")
+	if err != nil {
+		t.Fatalf("GetNetlinkSocketStats threw error (%v)", err)
+	}
+	// the tcp_info of the accepted connection depends on the loopback timings
+	if len(stats.ActiveInfos) != 1 || stats.ActiveInfos[0].RTT == 0 {
+		t.Errorf("expected the tcp_info of the accepted connection, actual %+v", stats.ActiveInfos)
+	}
+	stats.ActiveInfos = nil
+	// the inode of the accepted connection
+	inode := fmt.Sprint(socketInode(t, conn))
+	expected = SocketStats{ActiveWorkers: 1, States: TCPStates{1: 1, 10: 1}, QueueLimit: somaxconn, ActiveInodes: []string{inode}, HasTCPInfo: true}
+	if !reflect.DeepEqual(*stats, expected) {
+		t.Errorf("after accept: expected %v, actual %v", expected, *stats)
+	}
+}
+
+func TestGetNetlinkSocketStatsExcluded(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := listener{Port: ln.Addr().(*net.TCPAddr).Port}
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	excluded, _ := parseExcludedNets("127.0.0.0/8")
+	stats, err := GetNetlinkSocketStats(port, excluded, "")
+	if netlinkDenied(err) {
+		t.Skip("netlink is not available: ", err)
+	}
+	if err != nil {
+		t.Fatalf("GetNetlinkSocketStats threw error (%v)", err)
+	}
+	if stats.ActiveWorkers != 0 || stats.ExcludedWorkers != 1 {
+		t.Errorf("active/excluded are %v/%v expecting 0/1", stats.ActiveWorkers, stats.ExcludedWorkers)
+	}
+}
+
+func TestGetNetlinkSocketStatsAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	listeners := map[string]float64{
+		"127.0.0.1": 1,
+		"127.0.0.2": 0,
+	}
+	for addr, expected := range listeners {
+		l := listener{Address: netip.MustParseAddr(addr), Port: port}
+		stats, err := GetNetlinkSocketStats(l, nil, "")
+		if netlinkDenied(err) {
+			t.Skip("netlink is not available: ", err)
+		}
+		if err != nil {
+			t.Fatalf("GetNetlinkSocketStats threw error (%v)", err)
+		}
+		if stats.QueueSize != expected {
+			t.Errorf("%v: queued is %v expecting %v", l, stats.QueueSize, expected)
+		}
+	}
+}
+
+// socketInode returns the inode of the socket behind conn
+func socketInode(t *testing.T, conn net.Conn) uint64 {
+	f, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Ino
+}
+
+func TestGetNetlinkSocketStatsKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := listener{Port: ln.Addr().(*net.TCPAddr).Port}
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the request has been read, the response is not sent yet
+	buf := make([]byte, 16)
+	if _, err := client.Write([]byte("GET / HTTP/1.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := GetNetlinkSocketStats(port, nil, "")
+	if netlinkDenied(err) {
+		t.Skip("netlink is not available: ", err)
+	}
+	if err != nil {
+		t.Fatalf("GetNetlinkSocketStats threw error (%v)", err)
+	}
+	if stats.ActiveWorkers != 1 || stats.IdleWorkers != 0 {
+		t.Errorf("while processing: active/idle are %v/%v expecting 1/0", stats.ActiveWorkers, stats.IdleWorkers)
+	}
+
+	// the response has been sent and acknowledged
+	time.Sleep(5 * time.Millisecond)
+	if _, err := conn.Write([]byte("HTTP/1.1 200 OK")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	stats, err = GetNetlinkSocketStats(port, nil, "")
+	if err != nil {
+		t.Fatalf("GetNetlinkSocketStats threw error (%v)", err)
+	}
+	if stats.ActiveWorkers != 1 || stats.IdleWorkers != 1 {
+		t.Errorf("after the response: active/idle are %v/%v expecting 1/1", stats.ActiveWorkers, stats.IdleWorkers)
+	}
+}
+
+func TestGetNetlinkSocketStatsNetns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := listener{Port: ln.Addr().(*net.TCPAddr).Port}
+
+	// entering its own namespace requires the same privileges as any other
+	stats, err := GetNetlinkSocketStats(port, nil, "/proc/self/ns/net")
+	if netlinkDenied(err) {
+		t.Skip("entering a network namespace is not allowed: ", err)
+	}
+	if err != nil {
+		t.Fatalf("GetNetlinkSocketStats threw error (%v)", err)
+	}
+	if stats.States[10] != 1 {
+		t.Errorf("expected the listener in the namespace, actual %v", stats.States)
+	}
+
+	_, err = GetNetlinkSocketStats(port, nil, "/nonexistent/ns/net")
+	if err == nil {
+		t.Errorf("expected an error for a missing namespace")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNetlinkUnsupported = errors.New("netlink socket stats are only supported on linux")
+
+func netlinkDenied(err error) bool {
+	return errors.Is(err, errNetlinkUnsupported)
+}
+
+// GetNetlinkSocketStats is only implemented on linux
+func GetNetlinkSocketStats(l listener, excluded excludedNets, netns string) (*SocketStats, error) {
+	return nil, errNetlinkUnsupported
+}
@@ -3,24 +3,99 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"io/ioutil"
+	"net/netip"
+	"path/filepath"
 	"strconv"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type SocketStats struct {
 	QueueSize     float64
 	ActiveWorkers float64
+	States        TCPStates
+	// maximum size of the accept queue, 0 when unknown
+	QueueLimit float64
+	// ESTAB sockets left out of ActiveWorkers because of their remote address
+	ExcludedWorkers float64
+	// inodes of the sockets counted in ActiveWorkers
+	ActiveInodes []string
+	// sockets counted in ActiveWorkers which are idle keep-alive connections,
+	// only available when the sockets come with their tcp_info
+	IdleWorkers float64
+	// the sockets came with their tcp_info
+	HasTCPInfo bool
+	// tcp_info of the active connections
+	ActiveInfos []TCPInfo
+}
+
+// TCPStates counts the sockets in each TCP state, indexed by the kernel state code
+type TCPStates [len(tcpStateNames)]float64
+
+// tcpStateNames are the names `ss` uses for the TCP states, indexed by the kernel state code
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/include/net/tcp_states.h#n12
+var tcpStateNames = [...]string{
+	"",
+	"ESTAB",
+	"SYN-SENT",
+	"SYN-RECV",
+	"FIN-WAIT-1",
+	"FIN-WAIT-2",
+	"TIME-WAIT",
+	"UNCONN",
+	"CLOSE-WAIT",
+	"LAST-ACK",
+	"LISTEN",
+	"CLOSING",
+	"NEW-SYN-RECV",
+}
+
+// add counts a socket in connState
+func (t *TCPStates) add(connState string) {
+	for code, name := range tcpStateNames {
+		if name == connState && name != "" {
+			t[code]++
+			return
+		}
+	}
 }
 
 type Socket struct {
-	LocalPort int64
-	ConnState string
-	Inode     string
-	QueueSize float64
+	LocalAddr  netip.Addr
+	LocalPort  int64
+	RemoteAddr netip.Addr
+	ConnState  string
+	Inode      string
+	QueueSize  float64
+	// backlog of LISTEN sockets, only available through inet_diag
+	QueueLimit float64
+	// only available through inet_diag
+	Info *TCPInfo
+}
+
+// TCPInfo holds the fields of the kernel struct tcp_info raingutter uses
+type TCPInfo struct {
+	// segments sent but not acknowledged yet
+	Unacked uint32
+	// segments considered lost and retransmitted
+	Lost    uint32
+	Retrans uint32
+	// milliseconds since the last data was sent and received
+	LastDataSent uint32
+	LastDataRecv uint32
+	// smoothed round trip time in microseconds
+	RTT          uint32
+	TotalRetrans uint32
+}
+
+// idle reports whether the connection is an idle keep-alive connection: the last
+// response has been sent and acknowledged, and no data has been received since.
+// Otherwise a request is being processed or its response is still being sent
+func (i *TCPInfo) idle() bool {
+	return i.Unacked == 0 && i.LastDataSent < i.LastDataRecv
 }
 
 // strip out the `sl local_address remote_address...` menu and trailing whitespace
@@ -33,15 +108,16 @@ func stripMenu(s string) string {
 	}
 }
 
-// GetSocketStats combines the tcp and tcp6 /proc/net files to get a list of all ipv4 and ipv6 sockets
-func GetSocketStats() (string, error) {
-	s6, err := ioutil.ReadFile("/proc/net/tcp6")
+// GetSocketStats combines the tcp and tcp6 files of netDir, eg: /proc/net, to get a
+// list of all ipv4 and ipv6 sockets
+func GetSocketStats(netDir string) (string, error) {
+	s6, err := ioutil.ReadFile(filepath.Join(netDir, "tcp6"))
 	if err != nil {
 		return "", err
 	}
 	ipv6sockets := stripMenu(string(s6))
 
-	s4, err := ioutil.ReadFile("/proc/net/tcp")
+	s4, err := ioutil.ReadFile(filepath.Join(netDir, "tcp"))
 	if err != nil {
 		return "", err
 	}
@@ -51,100 +127,170 @@ func GetSocketStats() (string, error) {
 	return sockets, nil
 }
 
-// ParseSocket parses a line of /proc/net/tcp and returns a struct with some relevant info
-// reference: https://www.kernel.org/doc/Documentation/networking/proc_net_tcp.txt
-func ParseSocket(s string) (Socket, error) {
-	fields := strings.Fields(s)
-	if len(fields) < 9 {
-		return Socket{}, errors.New("could not parse socket - too few fields: " + s)
+// GetSomaxconn returns net.core.somaxconn, the upper bound the kernel applies to
+// the backlog of every listener, from procfs mounted at procRoot
+func GetSomaxconn(procRoot string) (float64, error) {
+	s, err := ioutil.ReadFile(filepath.Join(procRoot, "sys/net/core/somaxconn"))
+	if err != nil {
+		return 0, err
 	}
+	return strconv.ParseFloat(strings.TrimSpace(string(s)), 64)
+}
 
-	inode := fields[9]
-
-	localAddr := fields[1] // ipv4addr:port
-	lp := strings.Split(localAddr, ":")
-	if len(lp) < 2 {
-		return Socket{}, errors.New("could not parse socket local address: " + localAddr)
+// queueLimit estimates the backlog of a listener when the kernel can't tell us:
+// listen(2) silently truncates the backlog requested by the app to somaxconn
+func queueLimit(backlog float64, somaxconn float64) float64 {
+	if backlog <= 0 || backlog > somaxconn {
+		return somaxconn
 	}
-	localPort, err := strconv.ParseInt(lp[1], 16, 0)
-	if err != nil {
-		return Socket{}, err
+	return backlog
+}
+
+// connStateFromCode maps the hex state code used by /proc/net/tcp to the name of
+// the connection state
+func connStateFromCode(stateCode []byte) string {
+	code, ok := parseHex(stateCode)
+	if !ok || code > 0xff {
+		return ""
 	}
+	return tcpStateName(uint8(code))
+}
 
-	// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/include/net/tcp_states.h#n12
-	stateCode := fields[3]
-	var connState string
-	switch stateCode {
-	case "0A":
-		connState = "LISTEN"
-	case "01":
-		connState = "ESTAB"
-	case "06":
-		connState = "TIME-WAIT"
-	default:
-		connState = ""
+// tcpStateName returns the name of a kernel TCP state code
+func tcpStateName(code uint8) string {
+	if int(code) >= len(tcpStateNames) {
+		return ""
 	}
+	return tcpStateNames[code]
+}
 
-	qs := strings.Split(fields[4], ":") // transmit-queue:receive-queue
-	if len(qs) < 2 {
-		return Socket{}, errors.New("could not parse socket queue size: " + fields[6])
+// parseProcAddr decodes an address of /proc/net/tcp{,6}: the kernel prints each
+// 32 bits word of the address, which is in network byte order, as a host integer
+func parseProcAddr(s []byte) (netip.Addr, error) {
+	var b [16]byte
+	n := hex.DecodedLen(len(s))
+	if n != 4 && n != 16 {
+		return netip.Addr{}, errors.New("could not parse socket address: " + string(s))
 	}
-	queueSize, err := strconv.ParseInt(qs[1], 16, 0)
-	if err != nil {
-		return Socket{}, err
+	if _, err := hex.Decode(b[:n], s); err != nil {
+		return netip.Addr{}, errors.New("could not parse socket address: " + string(s))
+	}
+	for i := 0; i < n; i += 4 {
+		binary.NativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(b[i:]))
 	}
+	if n == 4 {
+		return netip.AddrFrom4([4]byte(b[:4])), nil
+	}
+	return netip.AddrFrom16(b), nil
+}
+
+// ParseSocket parses a line of /proc/net/tcp and returns a struct with some relevant info
+// reference: https://www.kernel.org/doc/Documentation/networking/proc_net_tcp.txt
+func ParseSocket(s string) (Socket, error) {
+	return parseSocketFields(splitFields([]byte(s), nil))
+}
 
-	return Socket{localPort, connState, inode, float64(queueSize)}, nil
+// addSocket folds a single socket on the monitored port into the stats
+func (s *SocketStats) addSocket(socket Socket, excluded excludedNets) {
+	s.States.add(socket.ConnState)
 
+	// we ignore TIME-WAIT sockets - they've been handed off to the kernel
+	// to sit on ice, Unicorn no longer cares
+	if socket.ConnState == "TIME-WAIT" {
+		return
+	}
+
+	// for the single LISTEN socket that all Unicorn workers poll on, look
+	// at the Recv-Q size as a measure of queue depth
+	if socket.ConnState == "LISTEN" {
+		s.QueueSize = socket.QueueSize
+		s.QueueLimit = socket.QueueLimit
+	}
+
+	// sockets in the ESTAB state are short-lived sockets that represent a request
+	// being handled by a single Unicorn process - we count these as a measure of
+	// active workers
+	// some ESTAB sockets have an inode of 0 - pretty sure these represent finished
+	// connections in the process of being handed off to the kernel to keep on
+	// TIME-WAIT. we assume Unicorn no longer cares about these and ignore them
+	// connections from excluded networks (eg: health checks) don't keep workers busy
+	if socket.ConnState == "ESTAB" && socket.Inode != "0" {
+		if excluded.contains(socket.RemoteAddr) {
+			s.ExcludedWorkers++
+		} else {
+			s.ActiveWorkers++
+			s.ActiveInodes = append(s.ActiveInodes, socket.Inode)
+			if socket.Info != nil {
+				s.ActiveInfos = append(s.ActiveInfos, *socket.Info)
+				if socket.Info.idle() {
+					s.IdleWorkers++
+				}
+			}
+		}
+	}
 }
 
-// TODO: investigate porting the Raindrops C implementation, which uses netlink for
-// a significantly more performant socket check
-// https://github.com/tmm1/raindrops/blob/1c18fd9c13f95fef6bcbdc0587d38886fa8e9064/ext/raindrops/linux_inet_diag.c#L295
+// ParseSocketStats aggregates the output of GetSocketStats for the given port.
+// GetNetlinkSocketStats is the faster alternative which lets the kernel do the filtering
 func ParseSocketStats(serverPort string, ssOutput string) (*SocketStats, error) {
 	port, err := strconv.Atoi(serverPort)
 	if err != nil {
 		return nil, err
 	}
+	return ParseListenersSocketStats([]listener{{Port: port}}, nil, ssOutput)[0], nil
+}
 
-	var queueSize float64
-	var activeWorkers float64
+// ParseListenersSocketStats aggregates the output of GetSocketStats for each of the
+// given TCP listeners, connections from the excluded networks are not counted as active.
+// Malformed lines are skipped
+func ParseListenersSocketStats(listeners []listener, excluded excludedNets, ssOutput string) []*SocketStats {
+	stats := make([]*SocketStats, len(listeners))
+	for i := range listeners {
+		stats[i] = &SocketStats{}
+	}
 
-	sockets := strings.Split(ssOutput, "\n")
-	for _, s := range sockets {
-		if s == "" {
-			continue
-		}
+	var r socketTableReader
+	// reading from a string never fails
+	_ = r.parse(strings.NewReader(ssOutput), false, listeners, excluded, stats)
+	return stats
+}
 
-		socket, err := ParseSocket(s)
-		if err != nil {
-			log.Error(err)
+// excludedNets are the remote networks whose connections are not counted as active
+type excludedNets []netip.Prefix
+
+// parseExcludedNets parses a comma separated list of CIDRs or single IP addresses
+func parseExcludedNets(s string) (excludedNets, error) {
+	var nets excludedNets
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
 			continue
 		}
-
-		// we only want sockets on our port (to filter for Unicorn sockets)
-		// we also ignore TIME-WAIT sockets - they've been handed off to the kernel
-		// to sit on ice, Unicorn no longer cares
-		if int(socket.LocalPort) != port || socket.ConnState == "TIME-WAIT" {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, netip.PrefixFrom(addr, addr.BitLen()))
 			continue
 		}
-
-		// for the single LISTEN socket that all Unicorn workers poll on, look
-		// at the Recv-Q size as a measure of queue depth
-		if socket.ConnState == "LISTEN" {
-			queueSize = socket.QueueSize
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
 		}
+		nets = append(nets, prefix.Masked())
+	}
+	return nets, nil
+}
 
-		// sockets in the ESTAB state are short-lived sockets that represent a request
-		// being handled by a single Unicorn process - we count these as a measure of
-		// active workers
-		// some ESTAB sockets have an inode of 0 - pretty sure these represent finished
-		// connections in the process of being handed off to the kernel to keep on
-		// TIME-WAIT. we assume Unicorn no longer cares about these and ignore them
-		if socket.ConnState == "ESTAB" && socket.Inode != "0" {
-			activeWorkers++
+// contains reports whether addr belongs to one of the networks. IPv4-mapped IPv6
+// addresses, as seen on dual stack listeners, match the IPv4 networks
+func (n excludedNets) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range n {
+		if prefix.Contains(addr) {
+			return true
 		}
 	}
-
-	return &SocketStats{queueSize, activeWorkers}, nil
+	return false
 }
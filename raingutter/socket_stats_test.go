@@ -3,6 +3,8 @@
 package main
 
 import (
+	"net/netip"
+	"reflect"
 	"testing"
 )
 
@@ -12,11 +14,11 @@ var SocketLines = []struct {
 }{
 	{
 		"0: 00000000:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0",
-		Socket{3000, "LISTEN", "296045765", 0},
+		Socket{LocalAddr: netip.IPv4Unspecified(), LocalPort: 3000, RemoteAddr: netip.IPv4Unspecified(), ConnState: "LISTEN", Inode: "296045765"},
 	},
 	{
 		"0: 00000000:0BB7 00000000:0000 01 0000000:95 00:00000000 00000000     0        0 123456 1 0000000000000000 100 0 0 10 0",
-		Socket{2999, "ESTAB", "123456", 149},
+		Socket{LocalAddr: netip.IPv4Unspecified(), LocalPort: 2999, RemoteAddr: netip.IPv4Unspecified(), ConnState: "ESTAB", Inode: "123456", QueueSize: 149},
 	},
 }
 
@@ -56,23 +58,23 @@ var SocketStatsLines = []struct {
 	{
 		"0: 00000000:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0",
 		"3000",
-		SocketStats{0, 0},
+		SocketStats{States: TCPStates{10: 1}},
 	},
 	{
 		"0: 00000000:0BB8 00000000:0000 0A 00000000:29A 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0",
 		"3000",
-		SocketStats{666, 0},
+		SocketStats{QueueSize: 666, States: TCPStates{10: 1}},
 	},
 	{
 		"0: 00000000:0BB7 00000000:0000 0A 00000000:8999 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0",
 		"3000",
-		SocketStats{0, 0},
+		SocketStats{},
 	},
 	{
 		`0: 00000000:0BB8 00000000:0000 0A 00000000:8999 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0
         1: 00000000:0BB8 00000000:0000 01 00000000:8999 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0`,
 		"3000",
-		SocketStats{35225, 1},
+		SocketStats{QueueSize: 35225, ActiveWorkers: 1, States: TCPStates{1: 1, 10: 1}, ActiveInodes: []string{"296045765"}},
 	},
 }
 
@@ -83,8 +85,189 @@ func TestParseSocketStats(t *testing.T) {
 			t.Errorf("ParseSocketStats threw error (%v)", err)
 		}
 
-		if *actual != out.expected {
+		if !reflect.DeepEqual(*actual, out.expected) {
 			t.Errorf("Parse(%v): expected %v, actual %v", out.raw, out.expected, actual)
 		}
 	}
 }
+
+func TestParseListenersSocketStats(t *testing.T) {
+	raw := `0: 00000000:0BB8 00000000:0000 0A 00000000:00000002 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0
+        1: 00000000:0BB8 00000000:0000 01 00000000:00000000 00:00000000 00000000     0        0 296045766 1 0000000000000000 100 0 0 10 0
+        2: 00000000:244C 00000000:0000 0A 00000000:00000001 00:00000000 00000000     0        0 296045767 1 0000000000000000 100 0 0 10 0
+        3: 00000000:244C 00000000:0000 01 00000000:00000000 00:00000000 00000000     0        0 296045768 1 0000000000000000 100 0 0 10 0
+        4: 00000000:244C 00000000:0000 01 00000000:00000000 00:00000000 00000000     0        0 296045769 1 0000000000000000 100 0 0 10 0
+        5: 00000000:0050 00000000:0000 01 00000000:00000000 00:00000000 00000000     0        0 296045770 1 0000000000000000 100 0 0 10 0`
+
+	expected := []*SocketStats{
+		{QueueSize: 2, ActiveWorkers: 1, States: TCPStates{1: 1, 10: 1}, ActiveInodes: []string{"296045766"}},
+		{QueueSize: 1, ActiveWorkers: 2, States: TCPStates{1: 2, 10: 1}, ActiveInodes: []string{"296045768", "296045769"}},
+		{},
+	}
+	actual := ParseListenersSocketStats([]listener{{Port: 3000}, {Port: 9292}, {Port: 4000}}, nil, raw)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("ParseListenersSocketStats: expected %v, actual %v", expected, actual)
+	}
+}
+
+var SocketStateLines = []struct {
+	code     string
+	expected string
+}{
+	{"01", "ESTAB"},
+	{"03", "SYN-RECV"},
+	{"08", "CLOSE-WAIT"},
+	{"0A", "LISTEN"},
+	{"0C", "NEW-SYN-RECV"},
+	{"0D", ""},
+	{"zz", ""},
+}
+
+func TestConnStateFromCode(t *testing.T) {
+	for _, out := range SocketStateLines {
+		actual := connStateFromCode([]byte(out.code))
+		if actual != out.expected {
+			t.Errorf("connStateFromCode(%v): expected %v, actual %v", out.code, out.expected, actual)
+		}
+	}
+}
+
+func TestParseSocketStatsStates(t *testing.T) {
+	raw := `0: 00000000:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0
+        1: 00000000:0BB8 00000000:0000 03 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 100 0 0 10 0
+        2: 00000000:0BB8 00000000:0000 08 00000000:00000000 00:00000000 00000000     0        0 296045767 1 0000000000000000 100 0 0 10 0
+        3: 00000000:0BB8 00000000:0000 08 00000000:00000000 00:00000000 00000000     0        0 296045768 1 0000000000000000 100 0 0 10 0
+        4: 00000000:0BB8 00000000:0000 06 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 100 0 0 10 0`
+
+	expected := SocketStats{States: TCPStates{3: 1, 6: 1, 8: 2, 10: 1}}
+	actual, err := ParseSocketStats("3000", raw)
+	if err != nil {
+		t.Errorf("ParseSocketStats threw error (%v)", err)
+	}
+	if !reflect.DeepEqual(*actual, expected) {
+		t.Errorf("ParseSocketStats: expected %v, actual %v", expected, *actual)
+	}
+}
+
+var QueueLimits = []struct {
+	backlog   float64
+	somaxconn float64
+	expected  float64
+}{
+	{0, 4096, 4096},
+	{1024, 4096, 1024},
+	{1024, 128, 128},
+}
+
+func TestQueueLimit(t *testing.T) {
+	for _, out := range QueueLimits {
+		actual := queueLimit(out.backlog, out.somaxconn)
+		if actual != out.expected {
+			t.Errorf("queueLimit(%v, %v): expected %v, actual %v", out.backlog, out.somaxconn, out.expected, actual)
+		}
+	}
+}
+
+var ProcAddrs = []struct {
+	raw      string
+	expected string
+}{
+	{"0100007F", "127.0.0.1"},
+	{"0A01A8C0", "192.168.1.10"},
+	{"00000000000000000000000001000000", "::1"},
+	{"0000000000000000FFFF00000100007F", "::ffff:127.0.0.1"},
+	{"B80D0120000000000000000001000000", "2001:db8::1"},
+}
+
+func TestParseProcAddr(t *testing.T) {
+	for _, out := range ProcAddrs {
+		actual, err := parseProcAddr([]byte(out.raw))
+		if err != nil {
+			t.Errorf("parseProcAddr threw error (%v)", err)
+		}
+		if actual.String() != out.expected {
+			t.Errorf("parseProcAddr(%v): expected %v, actual %v", out.raw, out.expected, actual)
+		}
+	}
+}
+
+func TestExcludedNets(t *testing.T) {
+	nets, err := parseExcludedNets("10.0.0.0/8, 192.168.1.1,fd00::/8")
+	if err != nil {
+		t.Fatalf("parseExcludedNets threw error (%v)", err)
+	}
+	addrs := map[string]bool{
+		"10.1.2.3":         true,
+		"::ffff:10.1.2.3":  true,
+		"192.168.1.1":      true,
+		"192.168.1.2":      false,
+		"fd12::1":          true,
+		"2001:db8::1":      false,
+		"::ffff:127.0.0.1": false,
+	}
+	for addr, expected := range addrs {
+		if actual := nets.contains(netip.MustParseAddr(addr)); actual != expected {
+			t.Errorf("contains(%v): expected %v, actual %v", addr, expected, actual)
+		}
+	}
+
+	if _, err := parseExcludedNets("10.0.0.0/33"); err == nil {
+		t.Errorf("parseExcludedNets did not raise error for an invalid CIDR")
+	}
+}
+
+func TestParseListenersSocketStatsExcluded(t *testing.T) {
+	// ESTAB connections from 10.0.0.1 and 192.168.1.10
+	raw := `0: 00000000:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0
+        1: 0100000A:0BB8 0100000A:D431 01 00000000:00000000 00:00000000 00000000     0        0 296045766 1 0000000000000000 100 0 0 10 0
+        2: 0100000A:0BB8 0A01A8C0:D432 01 00000000:00000000 00:00000000 00000000     0        0 296045767 1 0000000000000000 100 0 0 10 0`
+
+	excluded, _ := parseExcludedNets("10.0.0.0/8")
+	actual := ParseListenersSocketStats([]listener{{Port: 3000}}, excluded, raw)[0]
+	if actual.ActiveWorkers != 1 || actual.ExcludedWorkers != 1 {
+		t.Errorf("active/excluded are %v/%v expecting 1/1", actual.ActiveWorkers, actual.ExcludedWorkers)
+	}
+}
+
+func TestParseListenersSocketStatsAddress(t *testing.T) {
+	// two apps on port 3000, bound to 10.0.0.1 and 10.0.0.2, and a dual stack one on
+	// port 9292 accepting a connection on 10.0.0.1
+	raw := `0: 0100000A:0BB8 00000000:0000 0A 00000000:00000001 00:00000000 00000000     0        0 296045765 1 0000000000000000 100 0 0 10 0
+        1: 0100000A:0BB8 0A01A8C0:D431 01 00000000:00000000 00:00000000 00000000     0        0 296045766 1 0000000000000000 100 0 0 10 0
+        2: 0200000A:0BB8 00000000:0000 0A 00000000:00000002 00:00000000 00000000     0        0 296045767 1 0000000000000000 100 0 0 10 0
+        3: 0000000000000000FFFF00000100000A:244C 0000000000000000FFFF00000A01A8C0:D432 01 00000000:00000000 00:00000000 00000000     0        0 296045768 1 0000000000000000 100 0 0 10 0`
+
+	listeners, err := parseListeners("10.0.0.1:3000,10.0.0.2:3000,10.0.0.1:9292", "")
+	if err != nil {
+		t.Fatalf("parseListeners threw error (%v)", err)
+	}
+	expected := []*SocketStats{
+		{QueueSize: 1, ActiveWorkers: 1, States: TCPStates{1: 1, 10: 1}, ActiveInodes: []string{"296045766"}},
+		{QueueSize: 2, States: TCPStates{10: 1}},
+		{ActiveWorkers: 1, States: TCPStates{1: 1}, ActiveInodes: []string{"296045768"}},
+	}
+	actual := ParseListenersSocketStats(listeners, nil, raw)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("ParseListenersSocketStats: expected %v, actual %v", expected, actual)
+	}
+}
+
+var TCPInfos = []struct {
+	info     TCPInfo
+	expected bool
+}{
+	// request received, no response yet
+	{TCPInfo{LastDataRecv: 10, LastDataSent: 2000}, false},
+	// response sent and acknowledged
+	{TCPInfo{LastDataRecv: 2000, LastDataSent: 1000}, true},
+	// response still being sent
+	{TCPInfo{Unacked: 4, LastDataRecv: 2000, LastDataSent: 1}, false},
+}
+
+func TestTCPInfoIdle(t *testing.T) {
+	for _, out := range TCPInfos {
+		if actual := out.info.idle(); actual != out.expected {
+			t.Errorf("idle(%+v): expected %v, actual %v", out.info, out.expected, actual)
+		}
+	}
+}
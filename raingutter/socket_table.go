@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+// socketFields is the number of leading fields of /proc/net/tcp raingutter uses:
+// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+const socketFields = 10
+
+// socketTableReader streams the /proc/net/tcp{,6} tables into the stats of the
+// listeners. Only the local port of a line is decoded until it matches one of the
+// listeners, and the buffers are reused across polls
+type socketTableReader struct {
+	reader *bufio.Reader
+	fields [][]byte
+	// lines of the last read which could not be parsed
+	Malformed float64
+}
+
+// ReadListenersSocketStats reads the tcp and tcp6 tables of netDir, eg: /proc/net, and
+// aggregates them for each of the given TCP listeners the same way ParseListenersSocketStats does
+func (r *socketTableReader) ReadListenersSocketStats(netDir string, listeners []listener, excluded excludedNets) ([]*SocketStats, error) {
+	stats := make([]*SocketStats, len(listeners))
+	for i := range listeners {
+		stats[i] = &SocketStats{}
+	}
+
+	r.Malformed = 0
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(netDir, name))
+		if err != nil {
+			return nil, err
+		}
+		err = r.parse(f, true, listeners, excluded, stats)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// parse folds the sockets of a table into stats, skipping its header line if any
+func (r *socketTableReader) parse(src io.Reader, header bool, listeners []listener, excluded excludedNets, stats []*SocketStats) error {
+	if r.reader == nil {
+		r.reader = bufio.NewReaderSize(src, 64*1024)
+	} else {
+		r.reader.Reset(src)
+	}
+
+	for {
+		line, err := r.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// lines are about 150 bytes long, this one can't be a socket
+			for err == bufio.ErrBufferFull {
+				_, err = r.reader.ReadSlice('\n')
+			}
+			r.Malformed++
+		} else if header {
+			header = false
+		} else {
+			r.parseLine(line, listeners, excluded, stats)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *socketTableReader) parseLine(line []byte, listeners []listener, excluded excludedNets, stats []*SocketStats) {
+	r.fields = splitFields(line, r.fields[:0])
+	if len(r.fields) == 0 {
+		return
+	}
+	if len(r.fields) < socketFields {
+		r.Malformed++
+		return
+	}
+
+	// most sockets of the host are not on our listeners
+	_, rawPort, _ := bytes.Cut(r.fields[1], []byte{':'})
+	port, ok := parseHex(rawPort)
+	if !ok {
+		r.Malformed++
+		return
+	}
+	if !listeningOn(listeners, int(port)) {
+		return
+	}
+
+	socket, err := parseSocketFields(r.fields)
+	if err != nil {
+		r.Malformed++
+		return
+	}
+	for i, l := range listeners {
+		if l.matches(socket) {
+			stats[i].addSocket(socket, excluded)
+		}
+	}
+}
+
+// listeningOn reports whether one of the TCP listeners is bound to port
+func listeningOn(listeners []listener, port int) bool {
+	for _, l := range listeners {
+		if l.Path == "" && l.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFields appends the whitespace separated fields of line to fields, up to
+// socketFields of them, without copying them
+func splitFields(line []byte, fields [][]byte) [][]byte {
+	start := -1
+	for i, c := range line {
+		space := c == ' ' || c == '\t' || c == '\n' || c == '\r'
+		if space && start >= 0 {
+			fields = append(fields, line[start:i])
+			start = -1
+			if len(fields) == socketFields {
+				return fields
+			}
+		} else if !space && start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
+
+// parseSocketFields builds a Socket out of the fields of a line of /proc/net/tcp
+// reference: https://www.kernel.org/doc/Documentation/networking/proc_net_tcp.txt
+func parseSocketFields(fields [][]byte) (Socket, error) {
+	if len(fields) < socketFields {
+		return Socket{}, errors.New("could not parse socket - too few fields: " + string(bytes.Join(fields, []byte{' '})))
+	}
+
+	localIP, localPort, err := parseProcAddrPort(fields[1])
+	if err != nil {
+		return Socket{}, err
+	}
+	remoteIP, _, err := parseProcAddrPort(fields[2])
+	if err != nil {
+		return Socket{}, err
+	}
+
+	// transmit-queue:receive-queue
+	_, rx, ok := bytes.Cut(fields[4], []byte{':'})
+	queueSize, ok2 := parseHex(rx)
+	if !ok || !ok2 {
+		return Socket{}, errors.New("could not parse socket queue size: " + string(fields[4]))
+	}
+
+	return Socket{
+		LocalAddr:  localIP,
+		LocalPort:  int64(localPort),
+		RemoteAddr: remoteIP,
+		ConnState:  connStateFromCode(fields[3]),
+		Inode:      string(fields[9]),
+		QueueSize:  float64(queueSize),
+	}, nil
+}
+
+// parseProcAddrPort decodes an `address:port` of /proc/net/tcp{,6}
+func parseProcAddrPort(b []byte) (netip.Addr, uint64, error) {
+	rawAddr, rawPort, ok := bytes.Cut(b, []byte{':'})
+	if !ok {
+		return netip.Addr{}, 0, errors.New("could not parse socket address: " + string(b))
+	}
+	addr, err := parseProcAddr(rawAddr)
+	if err != nil {
+		return netip.Addr{}, 0, err
+	}
+	port, ok := parseHex(rawPort)
+	if !ok {
+		return netip.Addr{}, 0, errors.New("could not parse socket port: " + string(b))
+	}
+	return addr, port, nil
+}
+
+// parseHex parses an unsigned hexadecimal integer without allocating
+func parseHex(b []byte) (uint64, bool) {
+	if len(b) == 0 || len(b) > 16 {
+		return 0, false
+	}
+	var n uint64
+	for _, c := range b {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | uint64(c)
+	}
+	return n, true
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSocketTableReader(t *testing.T) {
+	netDir := t.TempDir()
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0BB8 00000000:0000 0A 00000000:00000002 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0BB8 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:0050 0100007F:D432 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:0BB8 0100007F:D433 01 00000000
+   4: 0100007F:0BB8 0100007F:D434 01 00000000:zz 00:00000000 00000000     0        0 1004 1 0000000000000000 20 4 30 10 -1
+   5: 0100007F:0050 0100007F:D435 01 00000000:zz 00:00000000 00000000     0        0 1005 1 0000000000000000 20 4 30 10 -1
+` + strings.Repeat("x", 70000) + `
+   6: 0100007F:0BB8 0100007F:D436 01 00000000:00000000 00:00000000 00000000     0        0 1006 1 0000000000000000 20 4 30 10 -1`
+	tcp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0000000000000000FFFF00000100007F:0BB8 0000000000000000FFFF00000100007F:D437 01 00000000:00000000 00:00000000 00000000     0        0 1007 1 0000000000000000 20 4 30 10 -1
+`
+	if err := os.WriteFile(filepath.Join(netDir, "tcp"), []byte(tcp), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(netDir, "tcp6"), []byte(tcp6), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var r socketTableReader
+	actual, err := r.ReadListenersSocketStats(netDir, []listener{{Port: 3000}}, nil)
+	if err != nil {
+		t.Fatalf("ReadListenersSocketStats threw error (%v)", err)
+	}
+	expected := []*SocketStats{
+		{QueueSize: 2, ActiveWorkers: 3, States: TCPStates{1: 3, 10: 1}, ActiveInodes: []string{"1002", "1006", "1007"}},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("ReadListenersSocketStats: expected %v, actual %v", expected, actual)
+	}
+	// lines on other ports are not parsed past their local port
+	if r.Malformed != 3 {
+		t.Errorf("malformed lines are %v expecting 3", r.Malformed)
+	}
+
+	// the counter is reset by every read
+	if _, err := r.ReadListenersSocketStats(netDir, []listener{{Port: 80}}, nil); err != nil {
+		t.Fatalf("ReadListenersSocketStats threw error (%v)", err)
+	}
+	if r.Malformed != 3 {
+		t.Errorf("malformed lines are %v expecting 3", r.Malformed)
+	}
+
+	if _, err := r.ReadListenersSocketStats(t.TempDir(), []listener{{Port: 80}}, nil); err == nil {
+		t.Errorf("ReadListenersSocketStats did not raise error for missing tables")
+	}
+}
+
+var HexValues = []struct {
+	raw      string
+	expected uint64
+	ok       bool
+}{
+	{"0BB8", 3000, true},
+	{"29a", 666, true},
+	{"FFFFFFFFFFFFFFFF", 1<<64 - 1, true},
+	{"", 0, false},
+	{"0x10", 0, false},
+	{"10000000000000000", 0, false},
+}
+
+func TestParseHex(t *testing.T) {
+	for _, out := range HexValues {
+		actual, ok := parseHex([]byte(out.raw))
+		if actual != out.expected || ok != out.ok {
+			t.Errorf("parseHex(%v): expected %v %v, actual %v %v", out.raw, out.expected, out.ok, actual, ok)
+		}
+	}
+}
+
+// writeSocketTables writes tcp and tcp6 tables of n sockets each to a temporary
+// directory, one socket in a hundred is on port 3000
+func writeSocketTables(tb testing.TB, n int) string {
+	netDir := tb.TempDir()
+	for _, name := range []string{"tcp", "tcp6"} {
+		var sb strings.Builder
+		sb.WriteString("  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n")
+		for i := 0; i < n; i++ {
+			port := 0x1F90 + i%100
+			if i%100 == 0 {
+				port = 0xBB8
+			}
+			local, remote := "0100007F", "0A00020F"
+			if name == "tcp6" {
+				local, remote = "0000000000000000FFFF00000100007F", "0000000000000000FFFF00000F02000A"
+			}
+			fmt.Fprintf(&sb, "%4d: %s:%04X %s:%04X 01 00000000:00000000 00:00000000 00000000  1000        0 %d 1 0000000000000000 20 4 30 10 -1\n",
+				i, local, port, remote, 40000+i%20000, 1000000+i)
+		}
+		if err := os.WriteFile(filepath.Join(netDir, name), []byte(sb.String()), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return netDir
+}
+
+// legacyParseListenersSocketStats is the procfs parser the socketTableReader replaced,
+// kept as the baseline of its benchmark: both tables are read into a single string
+// which is split into lines and fields
+func legacyParseListenersSocketStats(netDir string, listeners []listener) ([]*SocketStats, error) {
+	var tables []string
+	for _, name := range []string{"tcp", "tcp6"} {
+		s, err := os.ReadFile(filepath.Join(netDir, name))
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, stripMenu(string(s)))
+	}
+
+	stats := make([]*SocketStats, len(listeners))
+	for i := range listeners {
+		stats[i] = &SocketStats{}
+	}
+	for _, s := range strings.Split(strings.Join(tables, "\n"), "\n") {
+		if s == "" {
+			continue
+		}
+		socket, err := legacyParseSocket(s)
+		if err != nil {
+			continue
+		}
+		for i, l := range listeners {
+			if l.matches(socket) {
+				stats[i].addSocket(socket, nil)
+			}
+		}
+	}
+	return stats, nil
+}
+
+func legacyParseSocket(s string) (Socket, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 10 {
+		return Socket{}, errors.New("could not parse socket - too few fields: " + s)
+	}
+
+	lp := strings.Split(fields[1], ":")
+	if len(lp) < 2 {
+		return Socket{}, errors.New("could not parse socket local address: " + fields[1])
+	}
+	localIP, err := legacyParseProcAddr(lp[0])
+	if err != nil {
+		return Socket{}, err
+	}
+	localPort, err := strconv.ParseInt(lp[1], 16, 0)
+	if err != nil {
+		return Socket{}, err
+	}
+
+	ra := strings.Split(fields[2], ":")
+	if len(ra) < 2 {
+		return Socket{}, errors.New("could not parse socket remote address: " + fields[2])
+	}
+	remoteIP, err := legacyParseProcAddr(ra[0])
+	if err != nil {
+		return Socket{}, err
+	}
+
+	code, err := strconv.ParseUint(fields[3], 16, 8)
+	if err != nil {
+		return Socket{}, err
+	}
+
+	qs := strings.Split(fields[4], ":")
+	if len(qs) < 2 {
+		return Socket{}, errors.New("could not parse socket queue size: " + fields[4])
+	}
+	queueSize, err := strconv.ParseInt(qs[1], 16, 0)
+	if err != nil {
+		return Socket{}, err
+	}
+
+	return Socket{
+		LocalAddr:  localIP,
+		LocalPort:  localPort,
+		RemoteAddr: remoteIP,
+		ConnState:  tcpStateName(uint8(code)),
+		Inode:      fields[9],
+		QueueSize:  float64(queueSize),
+	}, nil
+}
+
+func legacyParseProcAddr(s string) (netip.Addr, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.Addr{}, errors.New("could not parse socket address: " + s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.NativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr, nil
+}
+
+func TestLegacyParseListenersSocketStats(t *testing.T) {
+	netDir := writeSocketTables(t, 1000)
+	listeners := []listener{{Port: 3000}}
+	expected, err := legacyParseListenersSocketStats(netDir, listeners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r socketTableReader
+	actual, err := r.ReadListenersSocketStats(netDir, listeners, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("the baseline and the socketTableReader disagree: %v, %v", expected, actual)
+	}
+}
+
+func BenchmarkLegacySocketStatsParser(b *testing.B) {
+	netDir := writeSocketTables(b, 10000)
+	listeners := []listener{{Port: 3000}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := legacyParseListenersSocketStats(netDir, listeners); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSocketTableReader(b *testing.B) {
+	netDir := writeSocketTables(b, 10000)
+	listeners := []listener{{Port: 3000}}
+	var r socketTableReader
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadListenersSocketStats(netDir, listeners, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// targetProcess is the process whose network namespace is monitored, so that a
+// privileged agent doesn't have to share it. Without a target raingutter monitors
+// its own network namespace
+type targetProcess struct {
+	Pid int
+	// the target is looked up by command line, and again when it exits
+	Pattern *regexp.Regexp
+	// where procfs is mounted, eg: /host/proc. Defaults to /proc
+	ProcRoot string
+}
+
+// procRoot returns where procfs is mounted
+func (t *targetProcess) procRoot() string {
+	if t.ProcRoot == "" {
+		return "/proc"
+	}
+	return t.ProcRoot
+}
+
+// netDir returns the directory holding the socket tables of the monitored namespace
+func (t *targetProcess) netDir() string {
+	if t.Pid == 0 {
+		return filepath.Join(t.procRoot(), "net")
+	}
+	return filepath.Join(t.procRoot(), strconv.Itoa(t.Pid), "net")
+}
+
+// netns returns the path of the monitored network namespace, empty for the one
+// raingutter lives in
+func (t *targetProcess) netns() string {
+	if t.Pid == 0 {
+		return ""
+	}
+	return filepath.Join(t.procRoot(), strconv.Itoa(t.Pid), "ns", "net")
+}
+
+// resolve looks the target up by Pattern if it has not been found yet or has exited.
+// It reports whether the target changed, in which case the state tied to the network
+// namespace of the previous one is stale
+func (t *targetProcess) resolve() (bool, error) {
+	if t.Pattern == nil {
+		return false, nil
+	}
+	if t.Pid != 0 && processMatches(t.procRoot(), t.Pid, t.Pattern) {
+		return false, nil
+	}
+
+	pids, err := findProcesses(t.procRoot(), t.Pattern)
+	if err != nil {
+		return false, err
+	}
+	if len(pids) == 0 {
+		t.Pid = 0
+		return false, errors.New("no process matches the target " + t.Pattern.String())
+	}
+	// the oldest process, usually the master of a pre-fork server
+	t.Pid = pids[0]
+	log.Info("monitoring the network namespace of pid ", t.Pid)
+	return true, nil
+}
+
+// findProcesses returns the sorted pids of the processes whose command line
+// matches pattern, raingutter excluded
+func findProcesses(procRoot string, pattern *regexp.Regexp) ([]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		if processMatches(procRoot, pid, pattern) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// processMatches reports whether the command line of pid matches pattern.
+// Processes which exit in the meantime don't match
+func processMatches(procRoot string, pid int, pattern *regexp.Regexp) bool {
+	cmdline, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	// arguments are separated by NUL bytes
+	return pattern.MatchString(strings.ReplaceAll(string(cmdline), "\x00", " "))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTargetProcessPaths(t *testing.T) {
+	target := targetProcess{}
+	if target.netDir() != "/proc/net" || target.netns() != "" {
+		t.Errorf("without a target: expected /proc/net and no namespace, actual %v and %v", target.netDir(), target.netns())
+	}
+	target = targetProcess{Pid: 42}
+	if target.netDir() != "/proc/42/net" || target.netns() != "/proc/42/ns/net" {
+		t.Errorf("with a target: expected /proc/42/net and /proc/42/ns/net, actual %v and %v", target.netDir(), target.netns())
+	}
+	target = targetProcess{Pid: 42, ProcRoot: "/host/proc"}
+	if target.netDir() != "/host/proc/42/net" || target.netns() != "/host/proc/42/ns/net" {
+		t.Errorf("with a procfs root: expected /host/proc/42/net and /host/proc/42/ns/net, actual %v and %v", target.netDir(), target.netns())
+	}
+}
+
+func TestTargetProcessResolve(t *testing.T) {
+	procRoot := t.TempDir()
+	writeProcess(t, procRoot, "21", "unicorn worker[0] -c config/unicorn.rb\x00", nil)
+	writeProcess(t, procRoot, "20", "unicorn master -c config/unicorn.rb\x00", nil)
+	writeProcess(t, procRoot, "7", "/usr/sbin/sshd\x00", nil)
+
+	target := targetProcess{Pattern: regexp.MustCompile("^unicorn "), ProcRoot: procRoot}
+	if changed, err := target.resolve(); err != nil || !changed {
+		t.Fatalf("resolve threw error or did not report the change (%v)", err)
+	}
+	if target.Pid != 20 {
+		t.Errorf("expected the oldest matching process 20, actual %v", target.Pid)
+	}
+
+	// a target which still runs is kept
+	writeProcess(t, procRoot, "3", "unicorn master -c config/unicorn.rb\x00", nil)
+	if changed, err := target.resolve(); err != nil || changed || target.Pid != 20 {
+		t.Errorf("expected to keep 20, actual %v (%v)", target.Pid, err)
+	}
+
+	// the target exited
+	target.Pattern = regexp.MustCompile("sshd")
+	target.Pid = 99
+	if changed, err := target.resolve(); err != nil || !changed || target.Pid != 7 {
+		t.Errorf("expected 7, actual %v (%v)", target.Pid, err)
+	}
+
+	target.Pattern = regexp.MustCompile("puma")
+	if _, err := target.resolve(); err == nil || target.Pid != 0 {
+		t.Errorf("expected an error without a matching process, actual %v", target.Pid)
+	}
+
+	// a target given by pid is never looked up
+	target = targetProcess{Pid: 99, ProcRoot: procRoot}
+	if changed, err := target.resolve(); err != nil || changed || target.Pid != 99 {
+		t.Errorf("expected to keep 99, actual %v (%v)", target.Pid, err)
+	}
+}
+
+// writeNamespace writes the tcp tables and the netstat counters of the network
+// namespace of pid, with a connection accepted on port 3000 on the socket inode
+func writeNamespace(t *testing.T, procRoot string, pid string, inode string, overflows string) {
+	writeProcFile(t, procRoot, pid+"/net/tcp", `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0BB8 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 `+inode+` 1 0000000000000000 20 4 30 10 -1
+`)
+	writeProcFile(t, procRoot, pid+"/net/tcp6", "  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n")
+	writeProcFile(t, procRoot, pid+"/net/netstat", "TcpExt: ListenOverflows ListenDrops\nTcpExt: "+overflows+" "+overflows+"\n")
+}
+
+func TestSocketMonitorTargetChange(t *testing.T) {
+	procRoot := t.TempDir()
+	writeProcess(t, procRoot, "20", "unicorn master -c config/unicorn.rb\x00", nil)
+	writeNamespace(t, procRoot, "20", "2001", "100")
+
+	target := targetProcess{Pattern: regexp.MustCompile("^unicorn master"), ProcRoot: procRoot}
+	opts := socketStatsOptions{ConnectionAge: true, Throughput: true}
+	m := newSocketMonitor("procfs", target, []listener{{Port: 3000}}, opts, time.Minute)
+	r := raingutter{}
+	for i := 0; i < 2; i++ {
+		if err := m.poll(&r); err != nil {
+			t.Fatalf("poll threw error (%v)", err)
+		}
+		m.collectListenDrops()
+	}
+
+	// the app is restarted in a new network namespace, with counters of its own
+	if err := os.RemoveAll(filepath.Join(procRoot, "20")); err != nil {
+		t.Fatal(err)
+	}
+	writeProcess(t, procRoot, "30", "unicorn master -c config/unicorn.rb\x00", nil)
+	writeNamespace(t, procRoot, "30", "3001", "7")
+	if err := m.poll(&r); err != nil {
+		t.Fatalf("poll threw error (%v)", err)
+	}
+	if m.Target.Pid != 30 {
+		t.Fatalf("expected to monitor 30, actual %v", m.Target.Pid)
+	}
+	// the connection of the new namespace was not accepted since the previous poll,
+	// and the one of the old namespace was not closed
+	if c := r.Listeners[0].Connections; c == nil || c.Accepted != 0 || len(c.Lifetimes) != 0 {
+		t.Errorf("expected no accepted nor closed connection, actual %+v", c)
+	}
+	if d := m.collectListenDrops(); d == nil || d.Overflows != 0 || d.Drops != 0 {
+		t.Errorf("expected no listen drops, actual %+v", d)
+	}
+}
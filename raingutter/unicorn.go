@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// workerCapacity discovers the number of workers of a Unicorn app by counting the
+// live children of its master, which tracks TTIN/TTOU scaling and worker respawns.
+// It requires raingutter to share the PID namespace of the app
+type workerCapacity struct {
+	// UNICORN_WORKERS of raingutter, used when the app doesn't have it in its
+	// environment, see configured
+	Configured float64
+	ProcRoot   string
+	// the app, whose environment is read when the master can't be found
+	App appProcess
+	// the master is found by pidfile, by command line, or as the process owning
+	// the socket listening on Port, in that order
+	PidFile       string
+	MasterPattern *regexp.Regexp
+	Port          int
+	// the process whose network namespace the app listens in, eg: RG_TARGET_PID
+	Target targetProcess
+	// children of the master which are counted as workers
+	WorkerPattern *regexp.Regexp
+}
+
+// discover returns the number of workers of the app along with where it comes from
+func (c *workerCapacity) discover() (float64, string, error) {
+	master, err := c.findMaster()
+	if err != nil {
+		if configured, source := c.configured(0); configured != 0 {
+			log.Debug(err)
+			return configured, source, nil
+		}
+		return 0, "", err
+	}
+
+	children, err := processChildren(c.ProcRoot, master)
+	if err != nil {
+		return 0, "", err
+	}
+	var workers float64
+	for _, pid := range children {
+		if c.WorkerPattern == nil || processMatches(c.ProcRoot, pid, c.WorkerPattern) {
+			workers++
+		}
+	}
+	if configured, source := c.configured(master); configured != 0 && workers != configured {
+		log.WithFields(log.Fields{
+			"configured": configured,
+			"source":     source,
+			"observed":   workers,
+			"master_pid": master,
+		}).Warning("the configured number of workers differs from the workers of the master")
+	}
+	return workers, "master:" + strconv.Itoa(master), nil
+}
+
+// configured returns the number of workers the app is configured with along with where
+// it comes from: the environment of the master, or of the app when the master is
+// unknown, and UNICORN_WORKERS of raingutter otherwise. 0 when unknown
+func (c *workerCapacity) configured(master int) (float64, string) {
+	if master == 0 {
+		if pids, err := c.App.find(c.ProcRoot); err == nil {
+			master = pids[0]
+		}
+	}
+	if master != 0 {
+		environ, err := readEnviron(c.ProcRoot, master)
+		if err == nil {
+			workers, name, err := environVar(environ, workersEnvVars)
+			if err != nil {
+				log.Warning(err)
+			} else if workers != 0 {
+				return workers, "environ:" + name
+			}
+		} else {
+			log.Debug(err)
+		}
+	}
+	if c.Configured != 0 {
+		return c.Configured, "UNICORN_WORKERS"
+	}
+	return 0, ""
+}
+
+// findMaster returns the pid of the Unicorn master
+func (c *workerCapacity) findMaster() (int, error) {
+	if c.PidFile != "" {
+		raw, err := os.ReadFile(c.PidFile)
+		if err != nil {
+			return 0, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return 0, errors.New("invalid pid in " + c.PidFile + ": " + string(raw))
+		}
+		// the pidfile outlives a master which was killed
+		if _, err := os.Stat(filepath.Join(c.ProcRoot, strconv.Itoa(pid))); err != nil {
+			return 0, err
+		}
+		return pid, nil
+	}
+
+	if c.MasterPattern != nil {
+		pids, err := findProcesses(c.ProcRoot, c.MasterPattern)
+		if err != nil {
+			return 0, err
+		}
+		if len(pids) > 0 {
+			// during a USR2 upgrade the old master is the oldest one
+			return pids[0], nil
+		}
+	}
+
+	if c.Port != 0 {
+		if _, err := c.Target.resolve(); err != nil {
+			return 0, err
+		}
+		return findListenerOwner(c.ProcRoot, c.Target.netDir(), c.Port)
+	}
+	return 0, errors.New("could not find the unicorn master")
+}
+
+// findListenerOwner returns the pid of the process which owns the socket of netDir, eg:
+// /proc/<pid>/net, listening on port: the workers inherit it from the master, which is
+// the one whose parent doesn't hold it
+func findListenerOwner(procRoot string, netDir string, port int) (int, error) {
+	inodes, err := listeningInodes(netDir, port)
+	if err != nil {
+		return 0, err
+	}
+	if len(inodes) == 0 {
+		return 0, errors.New("no socket listening on port " + strconv.Itoa(port))
+	}
+
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return 0, err
+	}
+	holders := make(map[int]bool)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		held, err := processSocketInodes(filepath.Join(procRoot, e.Name(), "fd"))
+		if err != nil {
+			continue
+		}
+		for _, inode := range held {
+			if inodes[inode] {
+				holders[pid] = true
+				break
+			}
+		}
+	}
+
+	master := 0
+	for pid := range holders {
+		ppid, err := processStatusField(procRoot, pid, "PPid")
+		if err != nil || holders[int(ppid)] {
+			continue
+		}
+		if master == 0 || pid < master {
+			master = pid
+		}
+	}
+	if master == 0 {
+		return 0, errors.New("could not find the process listening on port " + strconv.Itoa(port))
+	}
+	return master, nil
+}
+
+// listeningInodes returns the inodes of the sockets of netDir, eg: /proc/net,
+// listening on port
+func listeningInodes(netDir string, port int) (map[string]bool, error) {
+	inodes := make(map[string]bool)
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(netDir, name))
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		// skip the header
+		scanner.Scan()
+		for scanner.Scan() {
+			socket, err := ParseSocket(scanner.Text())
+			if err != nil {
+				continue
+			}
+			if socket.ConnState == "LISTEN" && int(socket.LocalPort) == port {
+				inodes[socket.Inode] = true
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inodes, nil
+}
+
+// processChildren returns the pids of the children of a process
+func processChildren(procRoot string, parent int) ([]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// processes which exit during the scan are skipped
+		if ppid, err := processStatusField(procRoot, pid, "PPid"); err == nil && int(ppid) == parent {
+			children = append(children, pid)
+		}
+	}
+	return children, nil
+}
+
+// getWorkers refreshes the number of workers of the app. The previous value is kept
+// when it can't be discovered
+func getWorkers(tc *totalConnections, capacity *workerCapacity) {
+	workers, source, err := capacity.discover()
+	if err != nil {
+		log.Warning("could not discover the number of workers: ", err)
+		return
+	}
+	if workers != tc.Count {
+		log.WithFields(log.Fields{
+			"workers": workers,
+			"source":  source,
+		}).Info("number of workers updated")
+	}
+	tc.Count = workers
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+// writeUnicorn creates a fake /proc with a unicorn master listening on port 3000,
+// 2 workers and a process it spawned which is not a worker
+func writeUnicorn(t *testing.T) string {
+	procRoot := t.TempDir()
+	listener := map[string]string{"3": "socket:[1001]"}
+	for _, p := range []struct {
+		pid, ppid, cmdline string
+		fds                map[string]string
+	}{
+		{"1", "0", "/sbin/init\x00", nil},
+		{"10", "1", "unicorn master -c config/unicorn.rb\x00", listener},
+		{"12", "10", "unicorn worker[0] -c config/unicorn.rb\x00", listener},
+		{"13", "10", "unicorn worker[1] -c config/unicorn.rb\x00", listener},
+		{"14", "10", "sh -c git rev-parse HEAD\x00", nil},
+		{"20", "1", "raingutter\x00", nil},
+	} {
+		writeProcess(t, procRoot, p.pid, p.cmdline, p.fds)
+		writeProcFile(t, procRoot, p.pid+"/status", "Name:\truby\nPPid:\t"+p.ppid+"\nThreads:\t2\n")
+	}
+	writeProcFile(t, procRoot, "net/tcp", `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2001 1 0000000000000000 100 0 0 10 0
+`)
+	writeProcFile(t, procRoot, "net/tcp6", `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+`)
+	return procRoot
+}
+
+func TestProcessChildren(t *testing.T) {
+	procRoot := writeUnicorn(t)
+	actual, err := processChildren(procRoot, 10)
+	if err != nil {
+		t.Fatalf("processChildren threw error (%v)", err)
+	}
+	sort.Ints(actual)
+	if expected := []int{12, 13, 14}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("processChildren: expected %v, actual %v", expected, actual)
+	}
+}
+
+func TestFindListenerOwner(t *testing.T) {
+	procRoot := writeUnicorn(t)
+	netDir := filepath.Join(procRoot, "net")
+	if actual, err := findListenerOwner(procRoot, netDir, 3000); err != nil || actual != 10 {
+		t.Errorf("findListenerOwner: expected 10, actual %v (%v)", actual, err)
+	}
+	// nobody holds the socket listening on 8080
+	for _, port := range []int{8080, 9000} {
+		if _, err := findListenerOwner(procRoot, netDir, port); err == nil {
+			t.Errorf("findListenerOwner(%v) did not raise error", port)
+		}
+	}
+}
+
+func TestWorkerCapacityTarget(t *testing.T) {
+	procRoot := writeUnicorn(t)
+	// the app listens in the network namespace of the master, not in raingutter's
+	tcp, err := os.ReadFile(filepath.Join(procRoot, "net/tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp6, err := os.ReadFile(filepath.Join(procRoot, "net/tcp6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeProcFile(t, procRoot, "10/net/tcp", string(tcp))
+	writeProcFile(t, procRoot, "10/net/tcp6", string(tcp6))
+	writeProcFile(t, procRoot, "net/tcp", "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n")
+
+	for _, target := range []targetProcess{
+		{Pid: 10, ProcRoot: procRoot},
+		{Pattern: regexp.MustCompile("^unicorn master"), ProcRoot: procRoot},
+	} {
+		capacity := workerCapacity{ProcRoot: procRoot, Port: 3000, WorkerPattern: regexp.MustCompile("worker"), Target: target}
+		if workers, source, err := capacity.discover(); err != nil || workers != 2 || source != "master:10" {
+			t.Errorf("discover: expected 2 from master:10, actual %v from %v (%v)", workers, source, err)
+		}
+	}
+
+	capacity := workerCapacity{ProcRoot: procRoot, Port: 3000, Target: targetProcess{ProcRoot: procRoot}}
+	if _, _, err := capacity.discover(); err == nil {
+		t.Errorf("discover did not raise error without the target")
+	}
+}
+
+func TestWorkerCapacityDiscover(t *testing.T) {
+	procRoot := writeUnicorn(t)
+	pidFile := filepath.Join(t.TempDir(), "unicorn.pid")
+	writeProcFile(t, filepath.Dir(pidFile), "unicorn.pid", "10\n")
+	stalePidFile := filepath.Join(t.TempDir(), "unicorn.pid")
+	writeProcFile(t, filepath.Dir(stalePidFile), "unicorn.pid", "11\n")
+	worker := regexp.MustCompile("worker")
+
+	for _, tc := range []struct {
+		name     string
+		capacity workerCapacity
+		workers  float64
+		source   string
+	}{
+		{"pidfile", workerCapacity{PidFile: pidFile, WorkerPattern: worker}, 2, "master:10"},
+		{"name", workerCapacity{MasterPattern: regexp.MustCompile("^unicorn master"), WorkerPattern: worker}, 2, "master:10"},
+		{"port", workerCapacity{Port: 3000, WorkerPattern: worker}, 2, "master:10"},
+		// the observed count wins over UNICORN_WORKERS
+		{"mismatch", workerCapacity{Configured: 4, Port: 3000, WorkerPattern: worker}, 2, "master:10"},
+		{"all children", workerCapacity{Port: 3000}, 3, "master:10"},
+		{"no master", workerCapacity{Configured: 4, PidFile: stalePidFile}, 4, "UNICORN_WORKERS"},
+	} {
+		tc.capacity.ProcRoot = procRoot
+		tc.capacity.Target = targetProcess{ProcRoot: procRoot}
+		workers, source, err := tc.capacity.discover()
+		if err != nil {
+			t.Errorf("%v: discover threw error (%v)", tc.name, err)
+			continue
+		}
+		if workers != tc.workers || source != tc.source {
+			t.Errorf("%v: expected %v from %v, actual %v from %v", tc.name, tc.workers, tc.source, workers, source)
+		}
+	}
+
+	for _, capacity := range []workerCapacity{
+		{ProcRoot: procRoot, PidFile: stalePidFile},
+		{ProcRoot: procRoot, MasterPattern: regexp.MustCompile("^puma")},
+		{ProcRoot: procRoot, Target: targetProcess{ProcRoot: procRoot}},
+	} {
+		if _, _, err := capacity.discover(); err == nil {
+			t.Errorf("discover did not raise error for %+v", capacity)
+		}
+	}
+}
+
+func TestWorkerCapacityConfigured(t *testing.T) {
+	procRoot := writeUnicorn(t)
+	capacity := workerCapacity{
+		Configured: 4,
+		ProcRoot:   procRoot,
+		App:        appProcess{Pattern: regexp.MustCompile("^unicorn master")},
+		// nothing listens on 8080, the master can't be found
+		Port:   8080,
+		Target: targetProcess{ProcRoot: procRoot},
+	}
+
+	if workers, source := capacity.configured(0); workers != 4 || source != "UNICORN_WORKERS" {
+		t.Errorf("configured: expected 4 from UNICORN_WORKERS, actual %v from %v", workers, source)
+	}
+
+	// the settings of the app are preferred to the ones of raingutter
+	writeProcFile(t, procRoot, "10/environ", "RAILS_ENV=production\x00WEB_CONCURRENCY=3\x00")
+	if workers, source, err := capacity.discover(); err != nil || workers != 3 || source != "environ:WEB_CONCURRENCY" {
+		t.Errorf("discover: expected 3 from environ:WEB_CONCURRENCY, actual %v from %v (%v)", workers, source, err)
+	}
+	writeProcFile(t, procRoot, "10/environ", "UNICORN_WORKERS=2\x00WEB_CONCURRENCY=3\x00")
+	if workers, source := capacity.configured(10); workers != 2 || source != "environ:UNICORN_WORKERS" {
+		t.Errorf("configured: expected 2 from environ:UNICORN_WORKERS, actual %v from %v", workers, source)
+	}
+
+	// invalid settings of the app are ignored
+	writeProcFile(t, procRoot, "10/environ", "UNICORN_WORKERS=0\x00")
+	if workers, source := capacity.configured(10); workers != 4 || source != "UNICORN_WORKERS" {
+		t.Errorf("configured: expected 4 from UNICORN_WORKERS, actual %v from %v", workers, source)
+	}
+}
+
+func TestGetWorkers(t *testing.T) {
+	procRoot := writeUnicorn(t)
+	capacity := workerCapacity{ProcRoot: procRoot, Port: 3000, WorkerPattern: regexp.MustCompile("worker"), Target: targetProcess{ProcRoot: procRoot}}
+	tc := totalConnections{}
+	getWorkers(&tc, &capacity)
+	if tc.Count != 2 {
+		t.Errorf("expected 2 workers, actual %v", tc.Count)
+	}
+
+	// TTIN
+	writeProcess(t, procRoot, "15", "unicorn worker[2] -c config/unicorn.rb\x00", nil)
+	writeProcFile(t, procRoot, "15/status", "Name:\truby\nPPid:\t10\n")
+	getWorkers(&tc, &capacity)
+	if tc.Count != 3 {
+		t.Errorf("expected 3 workers, actual %v", tc.Count)
+	}
+
+	// the master is gone, the last known value is kept
+	capacity.Port = 8080
+	getWorkers(&tc, &capacity)
+	if tc.Count != 3 {
+		t.Errorf("expected to keep 3 workers, actual %v", tc.Count)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type UnixSocket struct {
+	Path      string
+	Listening bool
+	ConnState string
+	Inode     string
+}
+
+// GetUnixSocketStats returns the list of unix domain sockets from unix in netDir,
+// eg: /proc/net/unix
+func GetUnixSocketStats(netDir string) (string, error) {
+	s, err := ioutil.ReadFile(filepath.Join(netDir, "unix"))
+	if err != nil {
+		return "", err
+	}
+	return stripMenu(string(s)), nil
+}
+
+// ParseUnixSocket parses a line of /proc/net/unix:
+// Num RefCount Protocol Flags Type St Inode Path
+// https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/net/unix/af_unix.c
+func ParseUnixSocket(s string) (UnixSocket, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 7 {
+		return UnixSocket{}, errors.New("could not parse unix socket - too few fields: " + s)
+	}
+
+	// unnamed sockets have no path
+	var path string
+	if len(fields) > 7 {
+		path = strings.Join(fields[7:], " ")
+	}
+
+	// __SO_ACCEPTCON is only set on listening sockets
+	listening := fields[3] == "00010000"
+
+	// the kernel reports the state of the struct socket. Connections which have
+	// not been accepted yet don't have one and are reported as SS_CONNECTING
+	var connState string
+	switch fields[5] {
+	case "01":
+		connState = "UNCONNECTED"
+	case "02":
+		connState = "CONNECTING"
+	case "03":
+		connState = "CONNECTED"
+	case "04":
+		connState = "DISCONNECTING"
+	default:
+		connState = ""
+	}
+
+	return UnixSocket{path, listening, connState, fields[6]}, nil
+}
+
+// ParseUnixSocketStats aggregates the output of GetUnixSocketStats for the listener
+// bound to socketPath, the same way Raindrops does for unix sockets
+// https://github.com/tmm1/raindrops/blob/1c18fd9c13f95fef6bcbdc0587d38886fa8e9064/lib/raindrops/linux.rb
+func ParseUnixSocketStats(socketPath string, output string) (*SocketStats, error) {
+	if socketPath == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+
+	stats := &SocketStats{}
+	for _, s := range strings.Split(output, "\n") {
+		if s == "" {
+			continue
+		}
+
+		socket, err := ParseUnixSocket(s)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		// accepted sockets inherit the path of the listener they came from
+		if socket.Path != socketPath || socket.Listening {
+			continue
+		}
+
+		switch socket.ConnState {
+		// connections waiting in the accept queue
+		case "CONNECTING":
+			stats.QueueSize++
+		// connections accepted by a worker
+		case "CONNECTED":
+			stats.ActiveWorkers++
+			stats.ActiveInodes = append(stats.ActiveInodes, socket.Inode)
+		}
+	}
+
+	return stats, nil
+}
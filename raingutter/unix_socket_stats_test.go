@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var UnixSocketLines = []struct {
+	raw      string
+	expected UnixSocket
+}{
+	{
+		"000000002d0ae79e: 00000002 00000000 00010000 0001 01 23337 /tmp/unicorn.sock",
+		UnixSocket{"/tmp/unicorn.sock", true, "UNCONNECTED", "23337"},
+	},
+	{
+		"000000007adc17b3: 00000003 00000000 00000000 0001 02     0 /tmp/unicorn.sock",
+		UnixSocket{"/tmp/unicorn.sock", false, "CONNECTING", "0"},
+	},
+	{
+		"000000008920d10b: 00000003 00000000 00000000 0001 03 23340",
+		UnixSocket{"", false, "CONNECTED", "23340"},
+	},
+}
+
+func TestParseUnixSocket(t *testing.T) {
+	for _, out := range UnixSocketLines {
+		actual, err := ParseUnixSocket(out.raw)
+		if err != nil {
+			t.Errorf("ParseUnixSocket threw error (%v)", err)
+		}
+
+		if actual != out.expected {
+			t.Errorf("ParseUnixSocket(%v): expected %v, actual %v", out.raw, out.expected, actual)
+		}
+	}
+}
+
+func TestParseUnixSocketErrors(t *testing.T) {
+	for _, line := range []string{"", "foo bar"} {
+		_, err := ParseUnixSocket(line)
+		if err == nil {
+			t.Errorf("ParseUnixSocket did not raise error for (%v)", line)
+		}
+	}
+}
+
+var UnixSocketStatsLines = []struct {
+	raw      string
+	path     string
+	expected SocketStats
+}{
+	{
+		"000000002d0ae79e: 00000002 00000000 00010000 0001 01 23337 /tmp/unicorn.sock",
+		"/tmp/unicorn.sock",
+		SocketStats{},
+	},
+	{
+		`000000002d0ae79e: 00000002 00000000 00010000 0001 01 23337 /tmp/unicorn.sock
+000000007adc17b3: 00000003 00000000 00000000 0001 02     0 /tmp/unicorn.sock
+000000007adc17b4: 00000003 00000000 00000000 0001 02     0 /tmp/unicorn.sock
+000000008920d10b: 00000003 00000000 00000000 0001 03 23340 /tmp/unicorn.sock
+000000008920d10c: 00000003 00000000 00000000 0001 03 23341 /tmp/other.sock
+000000008920d10d: 00000003 00000000 00000000 0001 03 23342`,
+		"/tmp/unicorn.sock",
+		SocketStats{QueueSize: 2, ActiveWorkers: 1, ActiveInodes: []string{"23340"}},
+	},
+}
+
+func TestParseUnixSocketStats(t *testing.T) {
+	for _, out := range UnixSocketStatsLines {
+		actual, err := ParseUnixSocketStats(out.path, out.raw)
+		if err != nil {
+			t.Errorf("ParseUnixSocketStats threw error (%v)", err)
+		}
+
+		if !reflect.DeepEqual(*actual, out.expected) {
+			t.Errorf("ParseUnixSocketStats(%v): expected %v, actual %v", out.raw, out.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watcherStats holds the aggregates Raindrops::Watcher computed for a listener over
+// its own sampling window, which catch the peaks happening between two polls
+type watcherStats struct {
+	Active watcherAggregate
+	Queued watcherAggregate
+}
+
+// watcherKind is the aggregate of either active or queued
+type watcherKind struct {
+	Name      string
+	Aggregate watcherAggregate
+}
+
+// kinds returns the aggregates of active and queued, in that order
+func (s *watcherStats) kinds() []watcherKind {
+	return []watcherKind{{"active", s.Active}, {"queued", s.Queued}}
+}
+
+// watcherAggregate is the summary of either active or queued, as reported by the
+// X-* headers of the Watcher
+type watcherAggregate struct {
+	Current float64
+	Mean    float64
+	StdDev  float64
+	Max     float64
+	// when Max was last recorded, zero if unknown
+	LastPeakAt time.Time
+}
+
+// peakAge returns how long ago Max was last recorded, 0 if unknown
+func (a watcherAggregate) peakAge(now time.Time) time.Duration {
+	if a.LastPeakAt.IsZero() {
+		return 0
+	}
+	return now.Sub(a.LastPeakAt)
+}
+
+// raindropsWatcher reads the aggregates served by a Raindrops::Watcher app
+type raindropsWatcher struct {
+	Client http.Client
+	// where the Watcher app is mounted, eg: http://127.0.0.1:3000/_watcher
+	URL string
+	// the addresses of the listeners as known to Raindrops, eg: 0.0.0.0:3000
+	Listeners []string
+}
+
+// Scan adds the Watcher aggregates to the stats of each listener of r. When current
+// is set, active and queued are the current values reported by the Watcher instead
+// of the ones of the Raindrops middleware, and the stats of r are reset first.
+// Otherwise the listeners the middleware doesn't report are skipped
+func (w *raindropsWatcher) Scan(r *raingutter, current bool, total bool) error {
+	if current {
+		r.Active = 0
+		r.Queued = 0
+		r.Listeners = r.Listeners[:0]
+	}
+	for _, addr := range w.Listeners {
+		if !current && r.listener(addr) == nil {
+			log.Warning("raindrops does not report the watcher listener ", addr)
+			continue
+		}
+		active, err := w.fetch("active", addr)
+		if err != nil {
+			return err
+		}
+		queued, err := w.fetch("queued", addr)
+		if err != nil {
+			return err
+		}
+
+		ls := r.raindropsListener(addr)
+		ls.Watcher = &watcherStats{Active: active, Queued: queued}
+		if current {
+			ls.Active = active.Current
+			ls.Queued = queued.Current
+			r.Active += ls.Active
+			r.Queued += ls.Queued
+		}
+	}
+	if current && total && len(r.Listeners) > 0 {
+		r.Listeners = append(r.Listeners, listenerStats{Listener: "total", Active: r.Active, Queued: r.Queued})
+	}
+	return nil
+}
+
+// fetch reads the aggregate of kind, active or queued, for the listener at addr
+func (w *raindropsWatcher) fetch(kind string, addr string) (watcherAggregate, error) {
+	u := strings.TrimSuffix(w.URL, "/") + "/" + kind + "/" + url.PathEscape(addr) + ".txt"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return watcherAggregate{}, err
+	}
+	req.Header.Set("User-Agent", "raingutter")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return watcherAggregate{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return watcherAggregate{}, errors.New("raindrops watcher return code for " + addr + " is: " + resp.Status)
+	}
+	return parseWatcherHeaders(resp.Header)
+}
+
+// parseWatcherHeaders reads the aggregate out of the headers of a Watcher response:
+// X-Mean, X-Std-Dev and X-Max are required, X-Current and X-Last-Peak-At optional
+func parseWatcherHeaders(h http.Header) (watcherAggregate, error) {
+	var a watcherAggregate
+	for _, f := range []struct {
+		header   string
+		value    *float64
+		required bool
+	}{
+		{"X-Current", &a.Current, false},
+		{"X-Mean", &a.Mean, true},
+		{"X-Std-Dev", &a.StdDev, true},
+		{"X-Max", &a.Max, true},
+	} {
+		raw := h.Get(f.header)
+		if raw == "" {
+			if f.required {
+				return watcherAggregate{}, errors.New("raindrops watcher response is missing " + f.header)
+			}
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return watcherAggregate{}, errors.New("invalid " + f.header + ": " + raw)
+		}
+		*f.value = v
+	}
+	if raw := h.Get("X-Last-Peak-At"); raw != "" {
+		t, err := http.ParseTime(raw)
+		if err != nil {
+			return watcherAggregate{}, errors.New("invalid X-Last-Peak-At: " + raw)
+		}
+		a.LastPeakAt = t
+	}
+	return a, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var lastPeakAt = time.Date(2023, time.March, 14, 9, 26, 53, 0, time.UTC)
+
+// watcherHandler answers like Raindrops::Watcher for 0.0.0.0:3000 and /tmp/unicorn.sock
+func watcherHandler(paths *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*paths = append(*paths, r.URL.EscapedPath())
+		var current, max string
+		switch r.URL.Path {
+		case "/_watcher/active/0.0.0.0:3000.txt":
+			current, max = "3", "12"
+		case "/_watcher/queued/0.0.0.0:3000.txt":
+			current, max = "1", "7"
+		case "/_watcher/active//tmp/unicorn.sock.txt", "/_watcher/queued//tmp/unicorn.sock.txt":
+			current, max = "0", "2"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Count", "1200")
+		w.Header().Set("X-Current", current)
+		w.Header().Set("X-Mean", "2.5")
+		w.Header().Set("X-Std-Dev", "1.25")
+		w.Header().Set("X-Max", max)
+		w.Header().Set("X-Last-Peak-At", lastPeakAt.Format(http.TimeFormat))
+	})
+}
+
+func TestParseWatcherHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Mean", "2.5")
+	h.Set("X-Std-Dev", "1.25")
+	h.Set("X-Max", "12")
+	actual, err := parseWatcherHeaders(h)
+	if err != nil {
+		t.Fatalf("parseWatcherHeaders threw error (%v)", err)
+	}
+	expected := watcherAggregate{Mean: 2.5, StdDev: 1.25, Max: 12}
+	if actual != expected || actual.peakAge(time.Now()) != 0 {
+		t.Errorf("parseWatcherHeaders: expected %+v, actual %+v", expected, actual)
+	}
+
+	h.Set("X-Last-Peak-At", lastPeakAt.Format(http.TimeFormat))
+	h.Set("X-Current", "3")
+	actual, _ = parseWatcherHeaders(h)
+	if actual.Current != 3 || actual.peakAge(lastPeakAt.Add(time.Minute)) != time.Minute {
+		t.Errorf("parseWatcherHeaders: expected the current value and the last peak, actual %+v", actual)
+	}
+
+	for _, header := range []string{"X-Max", "X-Last-Peak-At"} {
+		invalid := h.Clone()
+		invalid.Set(header, "yesterday")
+		if _, err := parseWatcherHeaders(invalid); err == nil {
+			t.Errorf("parseWatcherHeaders did not raise error with an invalid %v", header)
+		}
+	}
+	h.Del("X-Std-Dev")
+	if _, err := parseWatcherHeaders(h); err == nil {
+		t.Errorf("parseWatcherHeaders did not raise error without X-Std-Dev")
+	}
+}
+
+func TestWatcherScan(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(watcherHandler(&paths))
+	defer ts.Close()
+	w := raindropsWatcher{
+		Client:    *ts.Client(),
+		URL:       ts.URL + "/_watcher/",
+		Listeners: []string{"0.0.0.0:3000", "/tmp/unicorn.sock"},
+	}
+	tcp := &watcherStats{
+		Active: watcherAggregate{Current: 3, Mean: 2.5, StdDev: 1.25, Max: 12, LastPeakAt: lastPeakAt},
+		Queued: watcherAggregate{Current: 1, Mean: 2.5, StdDev: 1.25, Max: 7, LastPeakAt: lastPeakAt},
+	}
+	unix := &watcherStats{
+		Active: watcherAggregate{Current: 0, Mean: 2.5, StdDev: 1.25, Max: 2, LastPeakAt: lastPeakAt},
+		Queued: watcherAggregate{Current: 0, Mean: 2.5, StdDev: 1.25, Max: 2, LastPeakAt: lastPeakAt},
+	}
+
+	// along with the middleware, which doesn't report the unix socket: it is skipped
+	// rather than reported as idle
+	r := raingutter{}
+	r.Scan(&http.Response{Body: io.NopCloser(strings.NewReader("0.0.0.0:3000 active: 4\n0.0.0.0:3000 queued: 0\n"))}, false)
+	if err := w.Scan(&r, false, false); err != nil {
+		t.Fatalf("Scan threw error (%v)", err)
+	}
+	expected := []listenerStats{
+		{Listener: "0.0.0.0:3000", Active: 4, Watcher: tcp},
+	}
+	if !reflect.DeepEqual(r.Listeners, expected) || r.Active != 4 {
+		t.Errorf("Scan: expected %+v, actual %+v", expected, r.Listeners)
+	}
+	if len(paths) != 2 || paths[0] != "/_watcher/active/0.0.0.0:3000.txt" {
+		t.Errorf("expected to only fetch 0.0.0.0:3000, actual %v", paths)
+	}
+
+	// instead of the middleware
+	if err := w.Scan(&r, true, true); err != nil {
+		t.Fatalf("Scan threw error (%v)", err)
+	}
+	expected = []listenerStats{
+		{Listener: "0.0.0.0:3000", Active: 3, Queued: 1, Watcher: tcp},
+		{Listener: "/tmp/unicorn.sock", Watcher: unix},
+		{Listener: "total", Active: 3, Queued: 1},
+	}
+	if !reflect.DeepEqual(r.Listeners, expected) || r.Active != 3 || r.Queued != 1 {
+		t.Errorf("Scan: expected %+v, actual %+v", expected, r.Listeners)
+	}
+	if paths[4] != "/_watcher/active/%2Ftmp%2Funicorn.sock.txt" {
+		t.Errorf("expected the listeners to be escaped, actual %v", paths)
+	}
+
+	w.Listeners = []string{"0.0.0.0:4000"}
+	if err := w.Scan(&r, true, false); err == nil {
+		t.Errorf("Scan did not raise error for an unknown listener")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// workerProcess is a process of the app and the socket inodes it holds
+type workerProcess struct {
+	Pid    int
+	Inodes []string
+}
+
+// workerStats is the busy state of a worker process, as sent to the sinks
+type workerStats struct {
+	Pid  int
+	Busy bool
+	// age of the oldest active connection held by the worker
+	BusyFor time.Duration
+	// the worker has been holding the same connection for longer than the threshold
+	Stuck bool
+}
+
+// GetWorkerProcesses finds the processes whose command line matches pattern, along
+// with the inodes of the sockets they hold. It requires raingutter to share the PID
+// namespace of the app. Processes which exit during the scan, or whose file
+// descriptors can't be read, are skipped
+func GetWorkerProcesses(procRoot string, pattern *regexp.Regexp) ([]workerProcess, error) {
+	pids, err := findProcesses(procRoot, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var workers []workerProcess
+	for _, pid := range pids {
+		inodes, err := processSocketInodes(filepath.Join(procRoot, strconv.Itoa(pid), "fd"))
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+		workers = append(workers, workerProcess{pid, inodes})
+	}
+	return workers, nil
+}
+
+// processSocketInodes returns the inodes of the sockets in a /proc/<pid>/fd directory,
+// whose links look like `socket:[296045765]`
+func processSocketInodes(fdDir string) ([]string, error) {
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var inodes []string
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(link, "socket:[") && strings.HasSuffix(link, "]") {
+			inodes = append(inodes, link[len("socket:["):len(link)-1])
+		}
+	}
+	return inodes, nil
+}
+
+// workerTracker remembers when each active connection was first seen held by a
+// worker, to tell for how long the workers have been busy
+type workerTracker struct {
+	// workers busy for longer than threshold are reported as stuck
+	threshold time.Duration
+	firstSeen map[string]time.Time
+	stuck     map[int]bool
+}
+
+func newWorkerTracker(threshold time.Duration) *workerTracker {
+	return &workerTracker{
+		threshold: threshold,
+		firstSeen: map[string]time.Time{},
+		stuck:     map[int]bool{},
+	}
+}
+
+// update attributes the active connections to the workers holding them.
+// A warning is logged when a worker becomes stuck
+func (t *workerTracker) update(workers []workerProcess, activeInodes []string, now time.Time) []workerStats {
+	active := make(map[string]bool, len(activeInodes))
+	for _, inode := range activeInodes {
+		active[inode] = true
+	}
+
+	firstSeen := make(map[string]time.Time, len(t.firstSeen))
+	stuck := make(map[int]bool, len(t.stuck))
+	stats := make([]workerStats, 0, len(workers))
+	for _, w := range workers {
+		ws := workerStats{Pid: w.Pid}
+		for _, inode := range w.Inodes {
+			if !active[inode] {
+				continue
+			}
+			seen, ok := t.firstSeen[inode]
+			if !ok {
+				seen = now
+			}
+			firstSeen[inode] = seen
+
+			ws.Busy = true
+			if age := now.Sub(seen); age > ws.BusyFor {
+				ws.BusyFor = age
+			}
+		}
+
+		if t.threshold > 0 && ws.BusyFor > t.threshold {
+			ws.Stuck = true
+			stuck[w.Pid] = true
+			if !t.stuck[w.Pid] {
+				log.WithFields(log.Fields{
+					"pid":      w.Pid,
+					"busy_for": ws.BusyFor.String(),
+				}).Warn("worker has been holding a connection for longer than ", t.threshold)
+			}
+		}
+		stats = append(stats, ws)
+	}
+
+	// connections and workers which are gone are forgotten
+	t.firstSeen = firstSeen
+	t.stuck = stuck
+	return stats
+}
+
+// busyWorkers counts the workers holding at least one active connection
+func busyWorkers(workers []workerStats) float64 {
+	var busy float64
+	for _, w := range workers {
+		if w.Busy {
+			busy++
+		}
+	}
+	return busy
+}
+
+// stuckWorkers counts the workers busy for longer than the threshold
+func stuckWorkers(workers []workerStats) float64 {
+	var stuck float64
+	for _, w := range workers {
+		if w.Stuck {
+			stuck++
+		}
+	}
+	return stuck
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// writeProcess creates a fake /proc/<pid> with the given command line and links
+func writeProcess(t *testing.T, procRoot string, pid string, cmdline string, fds map[string]string) {
+	fdDir := filepath.Join(procRoot, pid, "fd")
+	if err := os.MkdirAll(fdDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(procRoot, pid, "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for fd, link := range fds {
+		if err := os.Symlink(link, filepath.Join(fdDir, fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetWorkerProcesses(t *testing.T) {
+	procRoot := t.TempDir()
+	writeProcess(t, procRoot, "10", "unicorn master -c config/unicorn.rb\x00", map[string]string{
+		"3": "socket:[100]",
+	})
+	writeProcess(t, procRoot, "12", "unicorn worker[1] -c config/unicorn.rb\x00", map[string]string{
+		"0": "/dev/null",
+		"3": "socket:[100]",
+		"7": "socket:[202]",
+	})
+	writeProcess(t, procRoot, "11", "unicorn worker[0] -c config/unicorn.rb\x00", map[string]string{
+		"3": "socket:[100]",
+		"6": "pipe:[300]",
+	})
+	if err := os.MkdirAll(filepath.Join(procRoot, "sys"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := GetWorkerProcesses(procRoot, regexp.MustCompile("worker"))
+	if err != nil {
+		t.Fatalf("GetWorkerProcesses threw error (%v)", err)
+	}
+	expected := []workerProcess{
+		{11, []string{"100"}},
+		{12, []string{"100", "202"}},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("GetWorkerProcesses: expected %v, actual %v", expected, actual)
+	}
+}
+
+func TestWorkerTracker(t *testing.T) {
+	tracker := newWorkerTracker(30 * time.Second)
+	start := time.Now()
+	workers := []workerProcess{
+		{11, []string{"100", "201"}},
+		{12, []string{"100", "202"}},
+	}
+
+	actual := tracker.update(workers, []string{"201"}, start)
+	expected := []workerStats{
+		{Pid: 11, Busy: true},
+		{Pid: 12},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("first poll: expected %v, actual %v", expected, actual)
+	}
+
+	// worker 11 is still on the same request, worker 12 picked up a new one
+	actual = tracker.update(workers, []string{"201", "202"}, start.Add(40*time.Second))
+	expected = []workerStats{
+		{Pid: 11, Busy: true, BusyFor: 40 * time.Second, Stuck: true},
+		{Pid: 12, Busy: true},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("second poll: expected %v, actual %v", expected, actual)
+	}
+	if busyWorkers(actual) != 2 || stuckWorkers(actual) != 1 {
+		t.Errorf("busy/stuck workers are %v/%v expecting 2/1", busyWorkers(actual), stuckWorkers(actual))
+	}
+
+	// worker 11 moved on to a new connection
+	workers[0].Inodes = []string{"100", "203"}
+	actual = tracker.update(workers, []string{"202", "203"}, start.Add(50*time.Second))
+	expected = []workerStats{
+		{Pid: 11, Busy: true},
+		{Pid: 12, Busy: true, BusyFor: 10 * time.Second},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("third poll: expected %v, actual %v", expected, actual)
+	}
+}